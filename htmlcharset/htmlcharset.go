@@ -0,0 +1,170 @@
+// Package htmlcharset detects the character encoding of HTML
+// documents and transcodes them to UTF-8, so they can be
+// tokenized by golang.org/x/net/html, which only reads UTF-8.
+package htmlcharset
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// prescanBytes is how much of a document we look at for a
+// <meta> charset, as in the HTML spec's prescan algorithm.
+const prescanBytes = 1024
+
+// UTF8 is the name Detect returns for UTF-8 documents.
+const UTF8 = "utf-8"
+
+// boms are the byte order marks we recognize, and the encodings
+// they mean. A BOM wins over anything a document declares.
+var boms = []struct {
+	bom  []byte
+	enc  encoding.Encoding
+	name string
+}{
+	{[]byte{0xEF, 0xBB, 0xBF}, encoding.Nop, UTF8},
+	{[]byte{0xFE, 0xFF}, unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "utf-16be"},
+	{[]byte{0xFF, 0xFE}, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "utf-16le"},
+}
+
+// Detect returns the encoding of an HTML document, and its name,
+// given the start of the document and its Content-Type header,
+// which may be empty. It looks, in order, for a byte order mark,
+// a charset in the Content-Type, and a <meta> charset in the first
+// 1024 bytes. If there are none, the document is taken to be UTF-8
+// if it looks like it, and windows-1252 otherwise, as browsers do.
+func Detect(prefix []byte, contentType string) (encoding.Encoding, string) {
+	for _, b := range boms {
+		if bytes.HasPrefix(prefix, b.bom) {
+			return b.enc, b.name
+		}
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if enc, name := lookup(params["charset"]); enc != nil {
+			return enc, name
+		}
+	}
+
+	if len(prefix) > prescanBytes {
+		prefix = prefix[:prescanBytes]
+	}
+	if enc, name := lookup(metaCharset(prefix)); enc != nil {
+		// A document can't declare itself as UTF-16 in a <meta>:
+		// if it could read the <meta>, it is ASCII compatible.
+		if strings.HasPrefix(name, "utf-16") {
+			return encoding.Nop, UTF8
+		}
+		return enc, name
+	}
+
+	if looksLikeUTF8(prefix) {
+		return encoding.Nop, UTF8
+	}
+	return charmap.Windows1252, "windows-1252"
+}
+
+// NewReader returns a reader that transcodes the HTML document
+// in r to UTF-8, and the name of the encoding it was in.
+// contentType is the Content-Type header, which may be empty.
+func NewReader(r io.Reader, contentType string) (io.Reader, string, error) {
+	br := bufio.NewReaderSize(r, prescanBytes)
+	prefix, err := br.Peek(prescanBytes)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, "", err
+	}
+
+	enc, name := Detect(prefix, contentType)
+	// Drop the BOM, or it would end up in the text.
+	for _, b := range boms {
+		if bytes.HasPrefix(prefix, b.bom) {
+			br.Discard(len(b.bom))
+			break
+		}
+	}
+	if enc == encoding.Nop {
+		return br, name, nil
+	}
+	return transform.NewReader(br, enc.NewDecoder()), name, nil
+}
+
+// lookup returns the encoding for a charset label, using
+// the names and aliases browsers accept, or nil if the
+// label is empty or not one we know.
+func lookup(label string) (encoding.Encoding, string) {
+	label = strings.TrimSpace(label)
+	if len(label) == 0 {
+		return nil, ""
+	}
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, ""
+	}
+	name, err := htmlindex.Name(enc)
+	if err != nil {
+		return nil, ""
+	}
+	if name == UTF8 {
+		return encoding.Nop, UTF8
+	}
+	return enc, name
+}
+
+// metaCharset returns the charset declared by the first <meta>
+// tag in prefix that declares one, either as <meta charset> or
+// as <meta http-equiv="Content-Type" content="...; charset=...">.
+func metaCharset(prefix []byte) string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(prefix))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "meta" {
+				continue
+			}
+			var httpEquiv, content string
+			for _, attr := range token.Attr {
+				switch strings.ToLower(attr.Key) {
+				case "charset":
+					return attr.Val
+				case "http-equiv":
+					httpEquiv = attr.Val
+				case "content":
+					content = attr.Val
+				}
+			}
+			if strings.EqualFold(strings.TrimSpace(httpEquiv), "content-type") {
+				if _, params, err := mime.ParseMediaType(content); err == nil && len(params["charset"]) > 0 {
+					return params["charset"]
+				}
+			}
+		}
+	}
+}
+
+// looksLikeUTF8 reports whether prefix is valid UTF-8, ignoring
+// a rune that may have been cut off at the end.
+func looksLikeUTF8(prefix []byte) bool {
+	for i := len(prefix) - 1; i >= 0 && i > len(prefix)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(prefix[i]) {
+			if !utf8.FullRune(prefix[i:]) {
+				prefix = prefix[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(prefix)
+}
@@ -0,0 +1,119 @@
+package htmlcharset
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNewReader(t *testing.T) {
+	cases := []struct {
+		name        string
+		input       []byte
+		contentType string
+		want        string
+		wantName    string
+	}{
+		{
+			name:     "plain ASCII",
+			input:    []byte("<title>Hello</title>"),
+			want:     "<title>Hello</title>",
+			wantName: "utf-8",
+		},
+		{
+			name:     "undeclared UTF-8",
+			input:    []byte("<title>café</title>"),
+			want:     "<title>café</title>",
+			wantName: "utf-8",
+		},
+		{
+			name:     "undeclared legacy bytes",
+			input:    []byte("<title>caf\xe9</title>"),
+			want:     "<title>café</title>",
+			wantName: "windows-1252",
+		},
+		{
+			name:        "Content-Type header",
+			input:       []byte("<title>\x93\xfa\x96\x7b</title>"),
+			contentType: "text/html; charset=Shift_JIS",
+			want:        "<title>日本</title>",
+			wantName:    "shift_jis",
+		},
+		{
+			name:     "meta charset",
+			input:    []byte("<meta charset=\"gbk\"><title>\xd6\xd0\xce\xc4</title>"),
+			want:     `<meta charset="gbk"><title>中文</title>`,
+			wantName: "gbk",
+		},
+		{
+			name:     "meta http-equiv",
+			input:    []byte("<META HTTP-EQUIV=\"Content-Type\" CONTENT=\"text/html; charset=windows-1252\"><title>caf\xe9</title>"),
+			want:     `<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=windows-1252"><title>café</title>`,
+			wantName: "windows-1252",
+		},
+		{
+			name:        "header wins over meta",
+			input:       []byte("<meta charset=\"gbk\"><title>caf\xe9</title>"),
+			contentType: "text/html; charset=iso-8859-1",
+			want:        `<meta charset="gbk"><title>café</title>`,
+			wantName:    "windows-1252",
+		},
+		{
+			name:        "BOM wins over header",
+			input:       []byte("\xef\xbb\xbf<title>café</title>"),
+			contentType: "text/html; charset=windows-1252",
+			want:        "<title>café</title>",
+			wantName:    "utf-8",
+		},
+		{
+			name:     "UTF-16 BOM",
+			input:    []byte("\xff\xfe<\x00p\x00>\x00\xe9\x00"),
+			want:     "<p>é",
+			wantName: "utf-16le",
+		},
+		{
+			name:     "meta can't say UTF-16",
+			input:    []byte(`<meta charset="utf-16"><title>café</title>`),
+			want:     `<meta charset="utf-16"><title>café</title>`,
+			wantName: "utf-8",
+		},
+		{
+			name:        "unknown charset",
+			input:       []byte("<title>café</title>"),
+			contentType: "text/html; charset=klingon",
+			want:        "<title>café</title>",
+			wantName:    "utf-8",
+		},
+		{
+			name:     "empty",
+			input:    []byte{},
+			want:     "",
+			wantName: "utf-8",
+		},
+	}
+
+	for _, c := range cases {
+		r, name, err := NewReader(bytes.NewReader(c.input), c.contentType)
+		if err != nil {
+			t.Errorf("\ncase: %s\nunexpected error: %v", c.name, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("\ncase: %s\nunexpected error reading: %v", c.name, err)
+			continue
+		}
+		if string(got) != c.want || name != c.wantName {
+			t.Errorf("\ncase: %s\ninput: %q\ngot: %q (%s)\nwant: %q (%s)", c.name, c.input, got, name, c.want, c.wantName)
+		}
+	}
+}
+
+func TestDetectOnlyPrescansStart(t *testing.T) {
+	// A <meta> after the first 1024 bytes is too late to count.
+	input := "<title>x</title>" + strings.Repeat(" ", prescanBytes) + `<meta charset="gbk">`
+	if _, name := Detect([]byte(input), ""); name != UTF8 {
+		t.Errorf("got %s, want %s", name, UTF8)
+	}
+}
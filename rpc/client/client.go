@@ -0,0 +1,264 @@
+// Package client provides a typed Go client for the SummaryService RPC server.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/zicodeng/go-example/rpc/models"
+)
+
+// serviceMethod is the name net/rpc registers
+// the SummaryService.GetPageSummary method under.
+const serviceMethod = "SummaryService.GetPageSummary"
+
+// Default settings used by New when the
+// corresponding Config field is left zero.
+const (
+	defaultPoolSize    = 4
+	defaultMaxRetries  = 3
+	defaultMinBackoff  = 50 * time.Millisecond
+	defaultMaxBackoff  = 2 * time.Second
+	defaultDialTimeout = 5 * time.Second
+)
+
+// ErrClosed is returned when calling a client after Close.
+var ErrClosed = errors.New("client is closed")
+
+// SummaryClient gets page summaries from a SummaryService.
+type SummaryClient interface {
+	// GetPageSummary returns the summary for pageURL.
+	GetPageSummary(ctx context.Context, pageURL string) (*models.PageSummary, error)
+	// Close releases the client's resources.
+	Close() error
+}
+
+// Config holds the settings for an RPCClient.
+type Config struct {
+	// Addr is the TCP address of the RPC server.
+	Addr string
+	// PoolSize is the maximum number of open connections,
+	// and so the maximum number of concurrent calls.
+	PoolSize int
+	// MaxRetries is how many times a call that failed because of
+	// a broken connection is retried on a new connection.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponential backoff
+	// between retries.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// DialTimeout bounds each connection attempt.
+	DialTimeout time.Duration
+}
+
+// RPCClient is a SummaryClient that talks to a SummaryService
+// over a pool of net/rpc connections. It is safe for concurrent use.
+type RPCClient struct {
+	cfg Config
+	// slots holds PoolSize entries. A nil entry is a slot that
+	// has no connection yet, or whose connection broke and has
+	// to be redialed by the next caller that takes it.
+	slots chan *rpc.Client
+
+	mx     sync.Mutex
+	closed bool
+}
+
+// New constructs a new RPCClient. Connections are dialed lazily,
+// so New never fails and the server doesn't need to be up yet.
+func New(cfg Config) *RPCClient {
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = defaultPoolSize
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+
+	c := &RPCClient{
+		cfg:   cfg,
+		slots: make(chan *rpc.Client, cfg.PoolSize),
+	}
+	for i := 0; i < cfg.PoolSize; i++ {
+		c.slots <- nil
+	}
+	return c
+}
+
+// GetPageSummary implements SummaryClient. Calls that fail because
+// the connection broke are retried with backoff on a new connection.
+// Errors returned by the server itself are not retried.
+func (c *RPCClient) GetPageSummary(ctx context.Context, pageURL string) (*models.PageSummary, error) {
+	var err error
+	for attempt := 0; attempt <= c.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+		var psum *models.PageSummary
+		psum, err = c.call(ctx, pageURL)
+		if err == nil {
+			return psum, nil
+		}
+		if !isRetryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d retries: %w", c.cfg.MaxRetries, err)
+}
+
+// call makes one attempt at the RPC on a pooled connection.
+func (c *RPCClient) call(ctx context.Context, pageURL string) (*models.PageSummary, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	psum := &models.PageSummary{}
+	call := conn.Go(serviceMethod, pageURL, psum, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		// The reply will still arrive on the connection and
+		// be dropped by net/rpc, so the connection stays usable.
+		c.put(conn)
+		return nil, ctx.Err()
+	}
+
+	if call.Error != nil && isRetryable(call.Error) {
+		// The connection is broken, so throw it away
+		// and let the next caller redial.
+		conn.Close()
+		c.put(nil)
+		return nil, call.Error
+	}
+	c.put(conn)
+	if call.Error != nil {
+		return nil, call.Error
+	}
+	return psum, nil
+}
+
+// get takes a connection out of the pool,
+// dialing a new one if the slot is empty.
+func (c *RPCClient) get(ctx context.Context) (*rpc.Client, error) {
+	var conn *rpc.Client
+	select {
+	case conn = <-c.slots:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c.mx.Lock()
+	closed := c.closed
+	c.mx.Unlock()
+	if closed {
+		c.put(conn)
+		return nil, ErrClosed
+	}
+	if conn != nil {
+		return conn, nil
+	}
+
+	dialer := net.Dialer{Timeout: c.cfg.DialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", c.cfg.Addr)
+	if err != nil {
+		c.put(nil)
+		return nil, fmt.Errorf("error dialing RPC server: %w", err)
+	}
+	return rpc.NewClient(netConn), nil
+}
+
+// put returns a connection, or an empty slot, to the pool.
+func (c *RPCClient) put(conn *rpc.Client) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed && conn != nil {
+		conn.Close()
+		conn = nil
+	}
+	c.slots <- conn
+}
+
+// Close implements SummaryClient. It closes idle connections
+// right away and connections in use once their call returns.
+func (c *RPCClient) Close() error {
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mx.Unlock()
+
+	// Empty the idle slots first and refill them afterwards,
+	// otherwise we would keep taking back the nils we put in.
+	idle := 0
+	for done := false; !done; {
+		select {
+		case conn := <-c.slots:
+			if conn != nil {
+				conn.Close()
+			}
+			idle++
+		default:
+			done = true
+		}
+	}
+	for i := 0; i < idle; i++ {
+		c.slots <- nil
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the given retry attempt:
+// exponential growth from MinBackoff, capped at MaxBackoff,
+// with jitter so clients don't retry in lockstep.
+func (c *RPCClient) backoff(attempt int) time.Duration {
+	d := c.cfg.MinBackoff << uint(attempt-1)
+	if d <= 0 || d > c.cfg.MaxBackoff {
+		d = c.cfg.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isRetryable reports whether err means the connection is
+// broken, as opposed to an error returned by the service.
+func isRetryable(err error) bool {
+	var serverErr rpc.ServerError
+	if errors.As(err, &serverErr) {
+		return false
+	}
+	return !errors.Is(err, ErrClosed) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
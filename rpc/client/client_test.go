@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zicodeng/go-example/rpc/models"
+)
+
+// stubService stands in for the real SummaryService.
+type stubService struct{}
+
+func (s *stubService) GetPageSummary(pageURL string, pageSummary *models.PageSummary) error {
+	if pageURL == "bad" {
+		return errors.New("bad URL")
+	}
+	pageSummary.URL = pageURL
+	return nil
+}
+
+// stubServer is an RPC server that can drop all its connections.
+type stubServer struct {
+	lis   net.Listener
+	mx    sync.Mutex
+	conns []net.Conn
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("SummaryService", &stubService{}); err != nil {
+		t.Fatalf("error registering service: %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	s := &stubServer{lis: lis}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			s.mx.Lock()
+			s.conns = append(s.conns, conn)
+			s.mx.Unlock()
+			go srv.ServeConn(conn)
+		}
+	}()
+	return s
+}
+
+func (s *stubServer) dropConns() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *stubServer) Close() {
+	s.lis.Close()
+	s.dropConns()
+}
+
+func TestRPCClient(t *testing.T) {
+	srv := newStubServer(t)
+	defer srv.Close()
+
+	c := New(Config{Addr: srv.lis.Addr().String(), PoolSize: 2, MinBackoff: time.Millisecond})
+	defer c.Close()
+	ctx := context.Background()
+
+	psum, err := c.GetPageSummary(ctx, "http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if psum.URL != "http://example.com" {
+		t.Errorf("incorrect URL returned: expected %s but got %s", "http://example.com", psum.URL)
+	}
+
+	// Errors from the service are returned as is.
+	var serverErr rpc.ServerError
+	if _, err := c.GetPageSummary(ctx, "bad"); !errors.As(err, &serverErr) {
+		t.Errorf("expected a server error but got %v", err)
+	}
+
+	// Dropped connections are redialed.
+	srv.dropConns()
+	if _, err := c.GetPageSummary(ctx, "http://example.com"); err != nil {
+		t.Errorf("unexpected error after dropping connections: %v", err)
+	}
+
+	// Canceled contexts are honored.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.GetPageSummary(canceled, "http://example.com"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v but got %v", context.Canceled, err)
+	}
+
+	c.Close()
+	if _, err := c.GetPageSummary(ctx, "http://example.com"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected %v but got %v", ErrClosed, err)
+	}
+}
+
+func TestRPCClientRetriesDial(t *testing.T) {
+	// Grab a free port, then close it so nothing is listening.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	c := New(Config{Addr: addr, MaxRetries: 2, MinBackoff: time.Millisecond})
+	defer c.Close()
+	if _, err := c.GetPageSummary(context.Background(), "http://example.com"); err == nil {
+		t.Error("expected an error dialing a closed port")
+	}
+}
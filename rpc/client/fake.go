@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/zicodeng/go-example/rpc/models"
+)
+
+// Fake is an in-memory SummaryClient for tests.
+// The zero value is ready to use and returns an error for every URL.
+type Fake struct {
+	// Summaries maps page URLs to the summaries returned for them.
+	Summaries map[string]*models.PageSummary
+	// Err, if set, is returned from every call instead of a summary.
+	Err error
+
+	mx    sync.Mutex
+	calls []string
+}
+
+// NewFake constructs a new Fake that returns the given summaries,
+// keyed by their URL field.
+func NewFake(summaries ...*models.PageSummary) *Fake {
+	f := &Fake{Summaries: map[string]*models.PageSummary{}}
+	for _, psum := range summaries {
+		f.Summaries[psum.URL] = psum
+	}
+	return f
+}
+
+// GetPageSummary implements SummaryClient.
+func (f *Fake) GetPageSummary(ctx context.Context, pageURL string) (*models.PageSummary, error) {
+	f.mx.Lock()
+	f.calls = append(f.calls, pageURL)
+	f.mx.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	psum, found := f.Summaries[pageURL]
+	if !found {
+		return nil, fmt.Errorf("no summary for %s", pageURL)
+	}
+	// Return a copy so callers can't modify the fake's data.
+	psumCopy := *psum
+	return &psumCopy, nil
+}
+
+// Calls returns the page URLs GetPageSummary was called with, in order.
+func (f *Fake) Calls() []string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Close implements SummaryClient.
+func (f *Fake) Close() error {
+	return nil
+}
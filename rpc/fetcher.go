@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Default limits used by NewFetcher when the
+// corresponding FetcherConfig field is left unset.
+const (
+	defaultFetchTimeout = 10 * time.Second
+	defaultMaxRedirects = 5
+	defaultMaxBodyBytes = 2 << 20 // 2MB
+)
+
+// Errors returned by the Fetcher. Callers can test for them
+// with errors.Is, since they are usually wrapped.
+var (
+	ErrSchemeNotAllowed = errors.New("only http and https URLs are allowed")
+	ErrHostNotAllowed   = errors.New("host is not allowed")
+	ErrBlockedAddress   = errors.New("address resolves to a blocked IP")
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrBodyTooLarge     = errors.New("response body too large")
+)
+
+// FetcherConfig holds the limits applied to every fetch.
+type FetcherConfig struct {
+	// Timeout bounds the entire fetch, including redirects
+	// and reading the body.
+	Timeout time.Duration
+	// MaxRedirects is the number of redirects that will be
+	// followed. It is a pointer so that zero can mean none:
+	// nil uses the default.
+	MaxRedirects *int
+	// MaxBodyBytes caps the number of response body bytes
+	// a caller can read.
+	MaxBodyBytes int64
+	// AllowedHosts, if not empty, is the only set of hosts
+	// that may be fetched. An entry also matches its subdomains.
+	AllowedHosts []string
+	// DeniedHosts are never fetched, even if they are allowed.
+	// An entry also matches its subdomains.
+	DeniedHosts []string
+}
+
+// Fetcher fetches user-supplied URLs without letting them
+// reach private, loopback or link-local addresses.
+type Fetcher struct {
+	cfg    FetcherConfig
+	client *http.Client
+	// allowLoopback disables the loopback check so tests
+	// can fetch from an httptest server.
+	allowLoopback bool
+}
+
+// NewFetcher constructs a new Fetcher.
+func NewFetcher(cfg FetcherConfig) *Fetcher {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultFetchTimeout
+	}
+	if cfg.MaxRedirects == nil {
+		maxRedirects := defaultMaxRedirects
+		cfg.MaxRedirects = &maxRedirects
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultMaxBodyBytes
+	}
+
+	f := &Fetcher{cfg: cfg}
+
+	// The IP check happens in the dialer's Control function,
+	// which runs after DNS resolution and right before connecting.
+	// That way a host name can't resolve to a safe address when we
+	// check it and a private one when we connect (DNS rebinding),
+	// and every redirect hop goes through the same check.
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		Control: f.checkDialAddress,
+	}
+	transport := &http.Transport{
+		// Never use a proxy from the environment,
+		// it would be the one dialing the real address.
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.Timeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	f.client = &http.Client{
+		Transport:     transport,
+		Timeout:       cfg.Timeout,
+		CheckRedirect: f.checkRedirect,
+	}
+	return f
+}
+
+// Fetch GETs the URL and returns the response.
+// The response body is capped at MaxBodyBytes; reading past
+// that returns ErrBodyTooLarge. Callers must close the body.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*http.Response, error) {
+	return f.fetch(ctx, rawURL, 0)
+}
+
+// FetchPrefix is like Fetch, but only asks for the first n bytes
+// of the resource and caps the body at n bytes. Servers are free to
+// ignore the Range header, so callers should stop reading once they
+// have what they need rather than rely on a 206 response.
+func (f *Fetcher) FetchPrefix(ctx context.Context, rawURL string, n int64) (*http.Response, error) {
+	return f.fetch(ctx, rawURL, n)
+}
+
+// fetch does the work for Fetch and FetchPrefix.
+// A prefix of 0 means the whole resource.
+func (f *Fetcher) fetch(ctx context.Context, rawURL string, prefix int64) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing URL: %v", err)
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	maxBytes := f.cfg.MaxBodyBytes
+	if prefix > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", prefix-1))
+		if prefix < maxBytes {
+			maxBytes = prefix
+		}
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &limitedBody{rc: resp.Body, remaining: maxBytes}
+	return resp, nil
+}
+
+// checkURL verifies the scheme and host of a URL
+// against the Fetcher's rules.
+func (f *Fetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: %q", ErrSchemeNotAllowed, u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if len(host) == 0 {
+		return fmt.Errorf("%w: empty host", ErrHostNotAllowed)
+	}
+	if matchesHost(host, f.cfg.DeniedHosts) {
+		return fmt.Errorf("%w: %s is denied", ErrHostNotAllowed, host)
+	}
+	if len(f.cfg.AllowedHosts) > 0 && !matchesHost(host, f.cfg.AllowedHosts) {
+		return fmt.Errorf("%w: %s is not in the allow list", ErrHostNotAllowed, host)
+	}
+	// Catch literal IPs early so we don't even try to dial them.
+	if ip := net.ParseIP(host); ip != nil && f.isBlockedIP(ip) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, ip)
+	}
+	return nil
+}
+
+// checkRedirect is used as the http.Client's CheckRedirect
+// so that every redirect target is checked as well.
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > *f.cfg.MaxRedirects {
+		return ErrTooManyRedirects
+	}
+	return f.checkURL(req.URL)
+}
+
+// checkDialAddress is used as the net.Dialer's Control function.
+// address is always a resolved "ip:port" at this point.
+func (f *Fetcher) checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || f.isBlockedIP(ip) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	return nil
+}
+
+// isBlockedIP reports whether the fetcher must not connect to ip.
+func (f *Fetcher) isBlockedIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return !f.allowLoopback
+	}
+	return isBlockedIP(ip)
+}
+
+// blockedNets are the ranges that aren't covered by
+// the net.IP helper methods used in isBlockedIP.
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+	"64:ff9b::/96",  // NAT64, can embed any IPv4 address
+)
+
+// isBlockedIP reports whether ip is a loopback, private,
+// link-local or otherwise non-public address.
+func isBlockedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHost reports whether host equals one of the
+// patterns or is a subdomain of one of them.
+func matchesHost(host string, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(p), "."))
+		if len(p) == 0 {
+			continue
+		}
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// mustParseCIDRs parses the given CIDR ranges, panicking if
+// one is invalid, since they are hard-coded above.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// limitedBody wraps a response body and fails with
+// ErrBodyTooLarge once more than `remaining` bytes are read.
+type limitedBody struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// Read one byte past the limit so we can tell
+	// a body of exactly the limit from a larger one.
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.rc.Read(p)
+	lb.remaining -= int64(n)
+	if lb.remaining < 0 {
+		return n + int(lb.remaining), ErrBodyTooLarge
+	}
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	return lb.rc.Close()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsBlockedIP(t *testing.T) {
+	cases := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"0.0.0.0", true},
+		{"100.64.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+	}
+
+	for _, c := range cases {
+		if output := isBlockedIP(net.ParseIP(c.ip)); output != c.blocked {
+			t.Errorf("\ninput: %s\ngot: %t\nwant: %t", c.ip, output, c.blocked)
+		}
+	}
+}
+
+func TestFetcherRejectsURLs(t *testing.T) {
+	f := NewFetcher(FetcherConfig{
+		AllowedHosts: []string{"example.com", "127.0.0.1"},
+		DeniedHosts:  []string{"private.example.com"},
+	})
+
+	cases := []struct {
+		name        string
+		url         string
+		expectedErr error
+	}{
+		{"non-http scheme", "file:///etc/passwd", ErrSchemeNotAllowed},
+		{"gopher scheme", "gopher://example.com", ErrSchemeNotAllowed},
+		{"host not in allow list", "http://example.org", ErrHostNotAllowed},
+		{"denied subdomain", "http://a.private.example.com", ErrHostNotAllowed},
+		{"loopback literal", "http://127.0.0.1:8080", ErrBlockedAddress},
+	}
+
+	for _, c := range cases {
+		if _, err := f.Fetch(context.Background(), c.url); !errors.Is(err, c.expectedErr) {
+			t.Errorf("\ncase: %s\ninput: %s\ngot: %v\nwant: %v", c.name, c.url, err, c.expectedErr)
+		}
+	}
+}
+
+func TestFetcherBlocksResolvedLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// "localhost" passes the URL checks and is only
+	// caught once it has been resolved to 127.0.0.1.
+	URL := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	if _, err := NewFetcher(FetcherConfig{}).Fetch(context.Background(), URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("fetching %s: got %v want %v", URL, err, ErrBlockedAddress)
+	}
+}
+
+func TestFetcherChecksRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	maxRedirects := 3
+	f := NewFetcher(FetcherConfig{MaxRedirects: &maxRedirects})
+	f.allowLoopback = true
+
+	if _, err := f.Fetch(context.Background(), srv.URL+"/metadata"); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("redirect to link-local address: got %v want %v", err, ErrBlockedAddress)
+	}
+	if _, err := f.Fetch(context.Background(), srv.URL+"/loop"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("redirect loop: got %v want %v", err, ErrTooManyRedirects)
+	}
+}
+
+func TestFetcherNoRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new", http.StatusFound)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	noRedirects := 0
+	f := NewFetcher(FetcherConfig{MaxRedirects: &noRedirects})
+	f.allowLoopback = true
+	if _, err := f.Fetch(context.Background(), srv.URL+"/old"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("redirect with MaxRedirects 0: got %v want %v", err, ErrTooManyRedirects)
+	}
+
+	// Left unset, MaxRedirects follows a few.
+	f = NewFetcher(FetcherConfig{})
+	f.allowLoopback = true
+	resp, err := f.Fetch(context.Background(), srv.URL+"/old")
+	if err != nil {
+		t.Fatalf("redirect with the default MaxRedirects: unexpected error: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestFetcherLimitsBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("a", 100))
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name        string
+		maxBytes    int64
+		expectedErr error
+	}{
+		{"under the limit", 200, nil},
+		{"exactly the limit", 100, nil},
+		{"over the limit", 50, ErrBodyTooLarge},
+	}
+
+	for _, c := range cases {
+		f := NewFetcher(FetcherConfig{MaxBodyBytes: c.maxBytes})
+		f.allowLoopback = true
+		resp, err := f.Fetch(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatalf("case %s: unexpected error fetching: %v", c.name, err)
+		}
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != c.expectedErr {
+			t.Errorf("\ncase: %s\ngot: %v\nwant: %v", c.name, err, c.expectedErr)
+		}
+	}
+}
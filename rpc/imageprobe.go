@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"net/http"
+	"sync"
+
+	// Register the decoders image.DecodeConfig can use.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"github.com/zicodeng/go-example/rpc/models"
+)
+
+// probeBytes is how much of an image we are willing to download
+// to find its dimensions. The size is in the first few bytes for
+// PNG, GIF and WebP, but a JPEG can have a lot of EXIF data before
+// its frame header.
+const probeBytes = 64 << 10
+
+// minPreviewSize is the smallest width or height a preview image
+// can have. Anything smaller is most likely a tracking pixel or icon.
+const minPreviewSize = 32
+
+// maxPreviews is the number of preview images we probe, and so
+// return, for a page. Later ones are dropped, since a page can
+// list any number of og:image tags.
+const maxPreviews = 8
+
+// probeConcurrency is the number of images probed at once.
+const probeConcurrency = 4
+
+// imageMIMETypes maps the format names reported by
+// image.DecodeConfig to MIME types.
+var imageMIMETypes = map[string]string{
+	"gif":  "image/gif",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+// probeImage fetches the start of an image and decodes
+// its header to find its dimensions and MIME type.
+func probeImage(ctx context.Context, fetcher *Fetcher, imageURL string) (width, height int, mimeType string, err error) {
+	resp, err := fetcher.FetchPrefix(ctx, imageURL, probeBytes)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("error fetching image %s: %w", imageURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, 0, "", fmt.Errorf("error response status code %d while fetching image %s", resp.StatusCode, imageURL)
+	}
+
+	// Sniff the format from the bytes rather than trusting
+	// the Content-Type header, which is often wrong for images.
+	cfg, format, err := image.DecodeConfig(resp.Body)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("error decoding image %s: %w", imageURL, err)
+	}
+	return cfg.Width, cfg.Height, imageMIMETypes[format], nil
+}
+
+// probePreviews fills in the size and type of the first
+// maxPreviews previews, and returns only the ones that are
+// usable: ones that could be decoded and aren't tiny. Every
+// preview is probed, even one that declares its size, since
+// pages often declare the size they display an image at, or
+// point at an image that has since gone. The type sniffed
+// from the image replaces the declared one for the same reason.
+func probePreviews(ctx context.Context, fetcher *Fetcher, previews []*models.PreviewImage) []*models.PreviewImage {
+	if len(previews) > maxPreviews {
+		previews = previews[:maxPreviews]
+	}
+
+	// Probe the images concurrently, since each probe is a
+	// network round trip, but only a few at a time.
+	broken := make([]bool, len(previews))
+	sem := make(chan struct{}, probeConcurrency)
+	wg := sync.WaitGroup{}
+	for i, preview := range previews {
+		wg.Add(1)
+		go func(i int, preview *models.PreviewImage) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			width, height, mimeType, err := probeImage(ctx, fetcher, preview.URL)
+			if err != nil {
+				broken[i] = true
+				return
+			}
+			preview.Width = width
+			preview.Height = height
+			preview.Type = mimeType
+		}(i, preview)
+	}
+	wg.Wait()
+
+	usable := make([]*models.PreviewImage, 0, len(previews))
+	for i, preview := range previews {
+		if broken[i] || preview.Width < minPreviewSize || preview.Height < minPreviewSize {
+			continue
+		}
+		usable = append(usable, preview)
+	}
+	return usable
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zicodeng/go-example/rpc/models"
+)
+
+func TestProbePreviews(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/big.png", func(w http.ResponseWriter, r *http.Request) {
+		png.Encode(w, image.NewRGBA(image.Rect(0, 0, 120, 80)))
+	})
+	mux.HandleFunc("/pixel.png", func(w http.ResponseWriter, r *http.Request) {
+		png.Encode(w, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	})
+	mux.HandleFunc("/broken.png", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "not an image")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{})
+	f.allowLoopback = true
+
+	previews := []*models.PreviewImage{
+		{URL: srv.URL + "/big.png", Alt: "big"},
+		{URL: srv.URL + "/pixel.png"},
+		{URL: srv.URL + "/broken.png"},
+		{URL: srv.URL + "/missing.png"},
+		// Declared dimensions and types are checked against the image.
+		{URL: srv.URL + "/broken.png", Width: 640, Height: 480},
+		{URL: srv.URL + "/pixel.png", Width: 640, Height: 480},
+		{URL: srv.URL + "/big.png", Type: "image/x-png", Width: 16, Height: 16},
+	}
+	expectedOutput := []*models.PreviewImage{
+		{URL: srv.URL + "/big.png", Alt: "big", Type: "image/png", Width: 120, Height: 80},
+		{URL: srv.URL + "/big.png", Type: "image/png", Width: 120, Height: 80},
+	}
+
+	output := probePreviews(context.Background(), f, previews)
+	if !reflect.DeepEqual(output, expectedOutput) {
+		t.Errorf("\ngot: %+v\nwant: %+v", output, expectedOutput)
+	}
+}
+
+func TestProbePreviewsLimits(t *testing.T) {
+	var mu sync.Mutex
+	probing, maxProbing := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		probing++
+		if probing > maxProbing {
+			maxProbing = probing
+		}
+		mu.Unlock()
+		// Give the other probes time to pile up.
+		time.Sleep(10 * time.Millisecond)
+		png.Encode(w, image.NewRGBA(image.Rect(0, 0, 120, 80)))
+		mu.Lock()
+		probing--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{})
+	f.allowLoopback = true
+
+	var previews []*models.PreviewImage
+	for i := 0; i < 3*maxPreviews; i++ {
+		previews = append(previews, &models.PreviewImage{URL: fmt.Sprintf("%s/%d.png", srv.URL, i)})
+	}
+	output := probePreviews(context.Background(), f, previews)
+	if len(output) != maxPreviews {
+		t.Errorf("got %d previews, want %d", len(output), maxPreviews)
+	}
+	if maxProbing > probeConcurrency {
+		t.Errorf("got %d concurrent probes, want at most %d", maxProbing, probeConcurrency)
+	}
+}
@@ -1,89 +1,126 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
-	"net"
 	"net/http"
-	"net/rpc"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zicodeng/go-example/rpc/models"
 )
 
 const rpcAddr = "localhost:6000"
 const httpAddr = "localhost:4000"
 
-// PreviewImage represents a page summary preview image.
-type PreviewImage struct {
-	URL    string
-	Alt    string
-	Width  int
-	Height int
+// SummaryHandler is an HTTP handler that
+// returns the PageSummary for the `url` form value.
+type SummaryHandler struct {
+	fetcher *Fetcher
 }
 
-// PageSummary represents a summary of a web page.
-type PageSummary struct {
-	URL         string
-	Title       string
-	Description string
-	Previews    []*PreviewImage
+// NewSummaryHandler constructs a new SummaryHandler.
+func NewSummaryHandler(fetcher *Fetcher) *SummaryHandler {
+	return &SummaryHandler{fetcher}
 }
 
-// newTestSummary returns a new PageSummary for testing purposes.
-func newTestSummary(pageURL string) *PageSummary {
-	return &PageSummary{
-		URL:         pageURL,
-		Title:       "Test title",
-		Description: "Test description",
-		Previews: []*PreviewImage{
-			{
-				URL:    pageURL + "/test.png",
-				Alt:    "A test image",
-				Width:  10,
-				Height: 20,
-			},
-		},
+// ServeHTTP implements the http.Handler interface for the SummaryHandler.
+func (sh *SummaryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pageURL := r.FormValue("url")
+	if len(pageURL) == 0 {
+		http.Error(w, "no url found in the request", http.StatusBadRequest)
+		return
+	}
+	pageSummary, err := getPageSummary(r.Context(), sh.fetcher, pageURL)
+	if err != nil {
+		http.Error(w, err.Error(), fetchErrorStatus(err))
+		return
 	}
-}
-
-// Implement an RPC service
-// and an HTTP handler function that
-// both accept a URL and return a PageSummary.
-
-func SummaryHandler(w http.ResponseWriter, r *http.Request) {
-	pageSummary := newTestSummary(r.FormValue("url"))
 	w.Header().Add("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(pageSummary)
 }
 
-type SummaryService struct{}
+// fetchErrorStatus maps a fetch error to an HTTP status code.
+// URLs we refuse to fetch are the client's fault,
+// anything else is a problem with the upstream page.
+func fetchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSchemeNotAllowed),
+		errors.Is(err, ErrHostNotAllowed),
+		errors.Is(err, ErrBlockedAddress):
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// SummaryService is an RPC service that
+// returns the PageSummary for a URL.
+type SummaryService struct {
+	fetcher *Fetcher
+	// ctx is what calls fetch with, since net/rpc doesn't give
+	// methods a context. The Server cancels it if calls are
+	// still running when it gives up draining them.
+	ctx context.Context
+}
 
 // A valid RPC service method can only accept two arguments:
 // 1. arg type
 // 2. reply type
-func (ss *SummaryService) GetPageSummary(pageURL string, pageSummary *PageSummary) error {
+func (ss *SummaryService) GetPageSummary(pageURL string, pageSummary *models.PageSummary) error {
+	psum, err := getPageSummary(ss.ctx, ss.fetcher, pageURL)
+	if err != nil {
+		return err
+	}
 	// Copy over the value.
-	*pageSummary = *newTestSummary(pageURL)
+	*pageSummary = *psum
 	return nil
 }
 
-func startRPC(addr string) {
-	// Start RPC server.
-	svc := &SummaryService{}
-	rpc.Register(svc)
-	// Listen directly on TCP socket on the server side.
-	lis, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("error binding to RPC port: %v", err)
+// splitHosts splits a comma-separated list of host names.
+func splitHosts(s string) []string {
+	if len(s) == 0 {
+		return nil
 	}
-	log.Printf("RPC server is listening at %s", addr)
-	rpc.Accept(lis)
+	return strings.Split(s, ",")
 }
 
 func main() {
-	// Start the RPC server on rpcAddr.
-	go startRPC(rpcAddr)
+	// Both servers fetch user-supplied URLs,
+	// so they share one hardened fetcher.
+	fetcher := NewFetcher(FetcherConfig{
+		AllowedHosts: splitHosts(os.Getenv("ALLOWED_HOSTS")),
+		DeniedHosts:  splitHosts(os.Getenv("DENIED_HOSTS")),
+	})
+
+	srv := NewServer(httpAddr, rpcAddr, fetcher)
+	// DRAIN_DELAY should be longer than the interval
+	// at which the load balancer polls /readyz.
+	if delay := os.Getenv("DRAIN_DELAY"); len(delay) > 0 {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			log.Fatalf("error parsing DRAIN_DELAY: %v", err)
+		}
+		srv.drainDelay = d
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", SummaryHandler)
-	log.Printf("HTTP server is listening at %s\n", httpAddr)
-	log.Fatal(http.ListenAndServe(httpAddr, mux))
+	// Run both servers until we get an interrupt or SIGTERM,
+	// then let in-flight requests and calls finish.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Once draining starts, stop catching the signals,
+	// so a second one kills the process straight away.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if err := srv.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("server stopped")
 }
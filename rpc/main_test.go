@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/rpc"
 	"testing"
+
+	"github.com/zicodeng/go-example/rpc/client"
+	"github.com/zicodeng/go-example/rpc/models"
 )
 
 // Run these benchmarks using:
@@ -15,14 +18,12 @@ const urlToSummarize = "http://example.com"
 
 func BenchmarkRPC(b *testing.B) {
 	// Implement a benchmark for the RPC server.
-	client, err := rpc.Dial("tcp", rpcAddr)
-	if err != nil {
-		b.Fatalf("error dialing RPC server: %v", err)
-	}
-	defer client.Close()
-	psum := &PageSummary{}
+	c := client.New(client.Config{Addr: rpcAddr})
+	defer c.Close()
+	ctx := context.Background()
 	for i := 0; i < b.N; i++ {
-		if err := client.Call("SummaryService.GetPageSummary", urlToSummarize, psum); err != nil {
+		psum, err := c.GetPageSummary(ctx, urlToSummarize)
+		if err != nil {
 			b.Fatalf("error calling RPC: %v", err)
 		}
 		if psum.URL != urlToSummarize {
@@ -34,7 +35,7 @@ func BenchmarkRPC(b *testing.B) {
 func BenchmarkHTTP(b *testing.B) {
 	// Implement a benchmark for the HTTP server.
 	summaryURL := fmt.Sprintf("http://%s?url=%s", httpAddr, urlToSummarize)
-	psum := &PageSummary{}
+	psum := &models.PageSummary{}
 	// N value will be automatically adjusted by Go testing library.
 	// It will keep running until get a consistent result.
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,18 @@
+package models
+
+// PreviewImage represents a page summary preview image.
+type PreviewImage struct {
+	URL    string
+	Alt    string
+	Type   string
+	Width  int
+	Height int
+}
+
+// PageSummary represents a summary of a web page.
+type PageSummary struct {
+	URL         string
+	Title       string
+	Description string
+	Previews    []*PreviewImage
+}
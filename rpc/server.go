@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout is how long in-flight HTTP requests
+// and RPC calls get to finish once shutdown starts.
+const defaultDrainTimeout = 15 * time.Second
+
+// defaultDrainDelay is how long we keep serving after /readyz
+// starts failing, so load balancers that poll it have time to
+// notice and stop sending us traffic before we stop listening.
+const defaultDrainDelay = 5 * time.Second
+
+// transportState is the lifecycle state of one transport.
+type transportState int
+
+const (
+	stateStarting transportState = iota
+	stateServing
+	stateDraining
+	stateStopped
+	stateFailed
+)
+
+func (ts transportState) String() string {
+	switch ts {
+	case stateStarting:
+		return "starting"
+	case stateServing:
+		return "serving"
+	case stateDraining:
+		return "draining"
+	case stateStopped:
+		return "stopped"
+	default:
+		return "failed"
+	}
+}
+
+// MarshalText lets the state be encoded as a string in JSON.
+func (ts transportState) MarshalText() ([]byte, error) {
+	return []byte(ts.String()), nil
+}
+
+// transportStatus is the body of the /healthz and /readyz responses.
+type transportStatus struct {
+	HTTP transportState `json:"http"`
+	RPC  transportState `json:"rpc"`
+}
+
+// Server runs the HTTP and RPC transports side by side
+// and stops them together.
+type Server struct {
+	httpAddr     string
+	rpcAddr      string
+	drainDelay   time.Duration
+	drainTimeout time.Duration
+
+	httpServer *http.Server
+	rpcServer  *rpc.Server
+	httpLis    net.Listener
+	rpcLis     net.Listener
+	// ctx is the parent of the contexts requests and calls
+	// fetch with. It is canceled if they are still running
+	// when the drain timeout expires, so they return.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mx protects everything below.
+	mx     sync.Mutex
+	status transportStatus
+	// rpcClosing is set once the RPC listener is being
+	// closed, after which no connection may be added.
+	rpcClosing bool
+	rpcConns   map[net.Conn]struct{}
+	rpcConnWG  sync.WaitGroup
+}
+
+// NewServer constructs a new Server that serves page
+// summaries over HTTP on httpAddr and RPC on rpcAddr.
+func NewServer(httpAddr, rpcAddr string, fetcher *Fetcher) *Server {
+	s := &Server{
+		httpAddr:     httpAddr,
+		rpcAddr:      rpcAddr,
+		drainDelay:   defaultDrainDelay,
+		drainTimeout: defaultDrainTimeout,
+		rpcServer:    rpc.NewServer(),
+		rpcConns:     map[net.Conn]struct{}{},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.rpcServer.Register(&SummaryService{fetcher, s.ctx})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", NewSummaryHandler(fetcher))
+	mux.HandleFunc("/healthz", s.healthHandler)
+	mux.HandleFunc("/readyz", s.readyHandler)
+	s.httpServer = &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return s.ctx },
+	}
+	return s
+}
+
+// Run listens on both addresses and serves until ctx is done.
+// It then fails /readyz, keeps serving for the drain delay, and
+// drains both transports, returning nil if everything stopped
+// within the drain timeout. If either transport fails, the other
+// is shut down straight away and the error is returned.
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+	return s.serve(ctx)
+}
+
+// listen binds both listeners, so that a port that is in use
+// is reported before anything starts serving.
+func (s *Server) listen() error {
+	httpLis, err := net.Listen("tcp", s.httpAddr)
+	if err != nil {
+		return fmt.Errorf("error binding to HTTP port: %v", err)
+	}
+	// Listen directly on TCP socket on the server side.
+	rpcLis, err := net.Listen("tcp", s.rpcAddr)
+	if err != nil {
+		httpLis.Close()
+		return fmt.Errorf("error binding to RPC port: %v", err)
+	}
+	s.httpLis = httpLis
+	s.rpcLis = rpcLis
+	return nil
+}
+
+// serve runs both transports on the bound listeners.
+func (s *Server) serve(ctx context.Context) error {
+	errc := make(chan error, 2)
+	s.setState(&s.status.HTTP, stateServing)
+	s.setState(&s.status.RPC, stateServing)
+
+	log.Printf("HTTP server is listening at %s", s.httpLis.Addr())
+	go func() {
+		if err := s.httpServer.Serve(s.httpLis); err != http.ErrServerClosed {
+			s.setState(&s.status.HTTP, stateFailed)
+			errc <- fmt.Errorf("HTTP server failed: %v", err)
+		}
+	}()
+
+	log.Printf("RPC server is listening at %s", s.rpcLis.Addr())
+	go func() {
+		if err := s.acceptRPC(); err != nil {
+			s.setState(&s.status.RPC, stateFailed)
+			errc <- fmt.Errorf("RPC server failed: %v", err)
+		}
+	}()
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case runErr = <-errc:
+		log.Printf("%v, shutting down", runErr)
+	}
+
+	// Both transports keep serving while draining, but /readyz
+	// fails. Give whatever polls it time to see that before the
+	// listeners close, unless a transport has already failed.
+	s.setState(&s.status.HTTP, stateDraining)
+	s.setState(&s.status.RPC, stateDraining)
+	if runErr == nil && s.drainDelay > 0 {
+		log.Printf("draining, shutting down in %v", s.drainDelay)
+		time.Sleep(s.drainDelay)
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	if err := s.shutdown(drainCtx); err != nil && runErr == nil {
+		runErr = err
+	}
+	s.cancel()
+	return runErr
+}
+
+// shutdown drains both transports concurrently, so they share
+// the same deadline. Whatever is still running when ctx is done
+// is closed forcefully, and the fetches it is waiting on canceled.
+func (s *Server) shutdown(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, s.cancel)
+	defer stop()
+
+	var httpErr, rpcErr error
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		httpErr = s.shutdownHTTP(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		rpcErr = s.shutdownRPC(ctx)
+	}()
+	wg.Wait()
+
+	if httpErr != nil {
+		return httpErr
+	}
+	return rpcErr
+}
+
+func (s *Server) shutdownHTTP(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.httpServer.Close()
+		err = fmt.Errorf("error draining HTTP server: %v", err)
+	}
+	s.setState(&s.status.HTTP, stateStopped)
+	return err
+}
+
+func (s *Server) shutdownRPC(ctx context.Context) error {
+	// Stop accepting, then unblock every connection that is waiting
+	// for its next request. Each connection's ServeConn loop then
+	// waits for its in-flight calls to reply before closing.
+	s.mx.Lock()
+	s.rpcClosing = true
+	s.mx.Unlock()
+	s.rpcLis.Close()
+	s.mx.Lock()
+	for conn := range s.rpcConns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.rpcConnWG.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.mx.Lock()
+		for conn := range s.rpcConns {
+			conn.Close()
+		}
+		s.mx.Unlock()
+		err = fmt.Errorf("error draining RPC server: %v", ctx.Err())
+	}
+	s.setState(&s.status.RPC, stateStopped)
+	return err
+}
+
+// acceptRPC accepts RPC connections until the listener is closed.
+// It returns nil if that happened because of a shutdown.
+func (s *Server) acceptRPC() error {
+	for {
+		conn, err := s.rpcLis.Accept()
+		if err != nil {
+			if s.rpcStopping() {
+				return nil
+			}
+			return err
+		}
+
+		s.mx.Lock()
+		// Registering the connection under the lock, after checking
+		// rpcClosing, guarantees shutdownRPC either sees it or it never
+		// gets served, so rpcConnWG.Add can't race with Wait.
+		if s.rpcClosing {
+			s.mx.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.rpcConns[conn] = struct{}{}
+		s.rpcConnWG.Add(1)
+		s.mx.Unlock()
+
+		go func() {
+			defer s.rpcConnWG.Done()
+			// ServeConn returns once the connection is closed or
+			// its read deadline passes, after replying to the
+			// calls it has read.
+			s.rpcServer.ServeConn(conn)
+			s.mx.Lock()
+			delete(s.rpcConns, conn)
+			s.mx.Unlock()
+		}()
+	}
+}
+
+func (s *Server) rpcStopping() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.rpcClosing
+}
+
+func (s *Server) setState(state *transportState, ts transportState) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	// Don't hide a failure behind a later state change.
+	if *state != stateFailed {
+		*state = ts
+	}
+}
+
+func (s *Server) getStatus() transportStatus {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.status
+}
+
+// healthHandler reports whether the process is alive:
+// it fails only if one of the transports has failed.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := s.getStatus()
+	code := http.StatusOK
+	if status.HTTP == stateFailed || status.RPC == stateFailed {
+		code = http.StatusServiceUnavailable
+	}
+	writeStatus(w, code, status)
+}
+
+// readyHandler reports whether the server should get traffic:
+// it succeeds only while both transports are serving.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	status := s.getStatus()
+	code := http.StatusOK
+	if status.HTTP != stateServing || status.RPC != stateServing {
+		code = http.StatusServiceUnavailable
+	}
+	writeStatus(w, code, status)
+}
+
+func writeStatus(w http.ResponseWriter, code int, status transportStatus) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
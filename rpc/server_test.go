@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zicodeng/go-example/rpc/client"
+)
+
+// getReady gets /readyz, returning the status
+// code and the state of each transport.
+func getReady(t *testing.T, readyURL string) (int, map[string]string) {
+	resp, err := http.Get(readyURL)
+	if err != nil {
+		t.Fatalf("error getting %s: %v", readyURL, err)
+	}
+	defer resp.Body.Close()
+	status := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("error decoding %s: %v", readyURL, err)
+	}
+	return resp.StatusCode, status
+}
+
+func TestServerDrainsInFlightCalls(t *testing.T) {
+	// A page that takes a while to load, so the RPC call
+	// is still in flight when the server starts shutting down.
+	pageHit := make(chan struct{})
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(pageHit)
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Add("Content-Type", "text/html")
+		io.WriteString(w, "<html><head><title>Slow page</title></head></html>")
+	}))
+	defer page.Close()
+
+	fetcher := NewFetcher(FetcherConfig{})
+	fetcher.allowLoopback = true
+	srv := NewServer("127.0.0.1:0", "127.0.0.1:0", fetcher)
+	srv.drainDelay = 100 * time.Millisecond
+	if err := srv.listen(); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- srv.serve(ctx) }()
+
+	readyURL := "http://" + srv.httpLis.Addr().String() + "/readyz"
+	serving := map[string]string{"http": "serving", "rpc": "serving"}
+	if code, status := getReady(t, readyURL); code != http.StatusOK || !reflect.DeepEqual(status, serving) {
+		t.Errorf("readyz returned %d %v, expected both transports serving", code, status)
+	}
+
+	c := client.New(client.Config{Addr: srv.rpcLis.Addr().String(), MaxRetries: -1})
+	defer c.Close()
+	called := make(chan error, 1)
+	go func() {
+		psum, err := c.GetPageSummary(context.Background(), page.URL)
+		if err == nil && psum.Title != "Slow page" {
+			t.Errorf("incorrect title returned: expected %s but got %s", "Slow page", psum.Title)
+		}
+		called <- err
+	}()
+
+	<-pageHit
+	cancel()
+
+	// While draining, /readyz keeps answering, but fails.
+	draining := map[string]string{"http": "draining", "rpc": "draining"}
+	deadline := time.Now().Add(time.Second)
+	for {
+		code, status := getReady(t, readyURL)
+		if code == http.StatusServiceUnavailable {
+			if !reflect.DeepEqual(status, draining) {
+				t.Errorf("readyz returned %v, expected both transports draining", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("readyz still returned %d %v after shutdown started", code, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := <-called; err != nil {
+		t.Errorf("in-flight call failed during shutdown: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("unexpected error shutting down: %v", err)
+	}
+	if status := srv.getStatus(); status.HTTP != stateStopped || status.RPC != stateStopped {
+		t.Errorf("expected both transports stopped but got %+v", status)
+	}
+}
+
+func TestServerCancelsCallsAfterDrainTimeout(t *testing.T) {
+	// A page that never loads, so the call is
+	// still in flight when the drain timeout expires.
+	pageHit := make(chan struct{})
+	pageCanceled := make(chan struct{})
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(pageHit)
+		select {
+		case <-r.Context().Done():
+			close(pageCanceled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer page.Close()
+
+	fetcher := NewFetcher(FetcherConfig{})
+	fetcher.allowLoopback = true
+	srv := NewServer("127.0.0.1:0", "127.0.0.1:0", fetcher)
+	srv.drainDelay = 0
+	srv.drainTimeout = 100 * time.Millisecond
+	if err := srv.listen(); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- srv.serve(ctx) }()
+
+	c := client.New(client.Config{Addr: srv.rpcLis.Addr().String(), MaxRetries: -1})
+	defer c.Close()
+	go c.GetPageSummary(context.Background(), page.URL)
+
+	<-pageHit
+	cancel()
+
+	select {
+	case <-pageCanceled:
+	case <-time.After(time.Second):
+		t.Fatal("the page fetch wasn't canceled after the drain timeout")
+	}
+	if err := <-served; err == nil {
+		t.Errorf("expected an error shutting down with a call still running")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/zicodeng/go-example/rpc/models"
+)
+
+const headerContentType = "Content-Type"
+const contentTypeHTML = "text/html"
+
+// getPageSummary fetches pageURL with the fetcher and
+// extracts a PageSummary from its <head>.
+func getPageSummary(ctx context.Context, fetcher *Fetcher, pageURL string) (*models.PageSummary, error) {
+	resp, err := fetcher.Fetch(ctx, pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", pageURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error response status code %d while fetching %s", resp.StatusCode, pageURL)
+	}
+	if !strings.HasPrefix(resp.Header.Get(headerContentType), contentTypeHTML) {
+		return nil, fmt.Errorf("%s is not an HTML page", pageURL)
+	}
+
+	// Resolve relative image URLs against the final URL,
+	// which may differ from pageURL after redirects.
+	psum, err := extractSummary(resp.Request.URL, resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting summary from %s: %w", pageURL, err)
+	}
+	psum.URL = pageURL
+	psum.Previews = probePreviews(ctx, fetcher, psum.Previews)
+	return psum, nil
+}
+
+// extractSummary reads the HTML stream until the end of
+// <head> and returns the summary found there.
+func extractSummary(baseURL *url.URL, body io.Reader) (*models.PageSummary, error) {
+	psum := &models.PageSummary{}
+	var preview *models.PreviewImage
+	tokenizer := html.NewTokenizer(body)
+	for {
+		ttype := tokenizer.Next()
+		if ttype == html.ErrorToken {
+			if err := tokenizer.Err(); err != io.EOF {
+				return psum, err
+			}
+			return psum, nil
+		}
+
+		token := tokenizer.Token()
+		if ttype == html.EndTagToken && token.Data == "head" {
+			// Everything we need is in the <head>.
+			return psum, nil
+		}
+		if ttype != html.StartTagToken && ttype != html.SelfClosingTagToken {
+			continue
+		}
+
+		switch token.Data {
+		case "title":
+			if len(psum.Title) == 0 && tokenizer.Next() == html.TextToken {
+				psum.Title = strings.TrimSpace(tokenizer.Token().Data)
+			}
+		case "meta":
+			prop := attrValue(token, "property")
+			if len(prop) == 0 {
+				prop = attrValue(token, "name")
+			}
+			content := attrValue(token, "content")
+			switch prop {
+			case "og:title":
+				psum.Title = content
+			case "og:description":
+				psum.Description = content
+			case "description":
+				// og:description wins over the plain description.
+				if len(psum.Description) == 0 {
+					psum.Description = content
+				}
+			case "og:image", "og:image:url", "og:image:secure_url":
+				// og:image:url and og:image:secure_url describe
+				// the current image rather than starting a new one.
+				if prop != "og:image" && preview != nil {
+					continue
+				}
+				imgURL, err := baseURL.Parse(content)
+				if err != nil {
+					continue
+				}
+				preview = &models.PreviewImage{URL: imgURL.String()}
+				psum.Previews = append(psum.Previews, preview)
+			case "og:image:type":
+				if preview != nil {
+					preview.Type = content
+				}
+			case "og:image:alt":
+				if preview != nil {
+					preview.Alt = content
+				}
+			case "og:image:width":
+				if preview != nil {
+					preview.Width, _ = strconv.Atoi(content)
+				}
+			case "og:image:height":
+				if preview != nil {
+					preview.Height, _ = strconv.Atoi(content)
+				}
+			}
+		}
+	}
+}
+
+// attrValue returns the value of the named attribute,
+// or an empty string if the token doesn't have it.
+func attrValue(token html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zicodeng/go-example/htmlcharset"
+)
+
+// Exit codes, so scripts can tell partial failure
+// apart from total failure.
+const (
+	exitOK        = 0
+	exitSomeFail  = 1
+	exitUsage     = 2
+	exitAllFailed = 3
+)
+
+const usage = `Usage: go run extract-meta.go [flags] <url|file|-> ...
+
+Each argument is a URL, an HTML file, a WARC archive of
+pages or - for stdin. Files and stdin can be gzipped.
+
+flags:
+`
+
+// pageMeta is the metadata of one page, as printed in JSON.
+// Relative URLs are resolved against the page URL.
+// OpenGraph and Twitter map each property to all its values,
+// in order, since properties like og:image can be repeated.
+type pageMeta struct {
+	URL         string              `json:"url"`
+	Error       string              `json:"error,omitempty"`
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Canonical   string              `json:"canonical,omitempty"`
+	Lang        string              `json:"lang,omitempty"`
+	Favicon     string              `json:"favicon,omitempty"`
+	OpenGraph   map[string][]string `json:"openGraph,omitempty"`
+	Twitter     map[string][]string `json:"twitter,omitempty"`
+	JSONLD      []json.RawMessage   `json:"jsonLD,omitempty"`
+	Feeds       []*feedLink         `json:"feeds,omitempty"`
+}
+
+// feedLink is an RSS, Atom or JSON feed a page links to
+// with <link rel="alternate">.
+type feedLink struct {
+	URL   string `json:"url"`
+	Type  string `json:"type"`
+	Title string `json:"title,omitempty"`
+}
+
+// feedTypes are the MIME types of the feeds we report.
+var feedTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+}
+
+// headTags are the elements that can be in the <head>.
+// Any other element starts the <body>, even without
+// a <body> tag.
+var headTags = map[string]bool{
+	"html":     true,
+	"head":     true,
+	"title":    true,
+	"meta":     true,
+	"link":     true,
+	"base":     true,
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+}
+
+// options are the settings from the command line
+// that apply to every argument.
+type options struct {
+	// readBody is whether to read past the <head>.
+	readBody bool
+	// timeout is how long fetching a URL may take.
+	timeout time.Duration
+}
+
+func main() {
+	opts := options{}
+	parallel := flag.Int("parallel", 4, "maximum number of URLs to fetch at the same time")
+	flag.BoolVar(&opts.readBody, "body", false, "also read the <body>, for its JSON-LD blocks and feed links")
+	flag.DurationVar(&opts.timeout, "timeout", 30*time.Second, "maximum time to fetch each URL")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// flag.Args() holds the arguments left after the flags.
+	if flag.NArg() < 1 || *parallel < 1 || opts.timeout <= 0 {
+		// Print the usage and exit with an error.
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	// Print each result as soon as it and all the
+	// results before it are in, so the output is in
+	// the same order as the arguments, one JSON
+	// object per line.
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	// Stop fetching on Ctrl-C, and print what
+	// failed because of it.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	total, failed := 0, 0
+	for _, results := range extractAll(ctx, flag.Args(), *parallel, opts) {
+		for meta := range results {
+			total++
+			if len(meta.Error) > 0 {
+				// The error is in the output, so carry on with the other pages.
+				failed++
+			}
+			if err := enc.Encode(meta); err != nil {
+				fmt.Fprintf(os.Stderr, "error writing output: %v\n", err)
+				os.Exit(exitAllFailed)
+			}
+		}
+	}
+
+	switch {
+	case failed == 0:
+		os.Exit(exitOK)
+	case failed == total:
+		os.Exit(exitAllFailed)
+	default:
+		os.Exit(exitSomeFail)
+	}
+}
+
+// extractAll extracts the metadata of the pages the arguments name
+// concurrently, at most `parallel` arguments at a time. It returns
+// a channel for each argument, in the same order, on which the
+// metadata of its pages is sent. The channel is closed after the
+// last one.
+func extractAll(ctx context.Context, args []string, parallel int, opts options) []<-chan *pageMeta {
+	// A buffered channel works as a semaphore: sending takes
+	// one of its slots, and receiving gives it back.
+	slots := make(chan struct{}, parallel)
+	results := make([]<-chan *pageMeta, len(args))
+	chans := make([]chan *pageMeta, len(args))
+	for i := range args {
+		// Buffer the channel, so a single page can finish
+		// even if nobody has received from it yet.
+		chans[i] = make(chan *pageMeta, 1)
+		results[i] = chans[i]
+	}
+	// Hand out the slots in the order of the arguments. An
+	// archive blocks until its pages are received, and they
+	// are received in order, so a later argument must never
+	// hold a slot an earlier one is waiting for.
+	go func() {
+		for i, arg := range args {
+			slots <- struct{}{}
+			go func(arg string, ch chan<- *pageMeta) {
+				defer func() { <-slots }()
+				defer close(ch)
+				extractArg(ctx, arg, opts, ch)
+			}(arg, chans[i])
+		}
+	}()
+	return results
+}
+
+// extractArg extracts the metadata of the pages an argument names,
+// sending it on results. A URL is fetched, "-" is read from stdin
+// and anything else is a file. Stdin and files can hold an HTML
+// page or a WARC archive of pages, and either can be gzipped.
+func extractArg(ctx context.Context, arg string, opts options, results chan<- *pageMeta) {
+	if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+		ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+		meta, err := fetchMeta(ctx, arg, opts.readBody)
+		if err != nil {
+			meta = &pageMeta{Error: err.Error()}
+		}
+		meta.URL = arg
+		results <- meta
+		return
+	}
+
+	var r io.Reader = os.Stdin
+	var base *url.URL
+	if arg != "-" {
+		f, err := os.Open(arg)
+		if err != nil {
+			results <- &pageMeta{URL: arg, Error: fmt.Sprintf("opening file failed: %v", err)}
+			return
+		}
+		defer f.Close()
+		r = f
+		// Resolve relative URLs against the file itself.
+		if path, err := filepath.Abs(arg); err == nil {
+			base = &url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+		}
+	}
+
+	if err := readFile(arg, r, base, opts.readBody, results); err != nil {
+		results <- &pageMeta{URL: arg, Error: err.Error()}
+	}
+}
+
+// readFile extracts the metadata of the HTML page or WARC archive
+// in r, which is named name, sending it on results.
+func readFile(name string, r io.Reader, base *url.URL, readBody bool, results chan<- *pageMeta) error {
+	br := bufio.NewReader(r)
+	// Gzipped files start with the bytes 1f 8b.
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		// A .warc.gz holds each record in a gzip stream
+		// of its own, and gzip.Reader reads them all.
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("decompressing file failed: %v", err)
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	if magic, _ := br.Peek(len(warcMagic)); string(magic) == warcMagic {
+		if err := readWARC(br, readBody, results); err != nil {
+			return fmt.Errorf("reading WARC archive failed: %v", err)
+		}
+		return nil
+	}
+
+	// There is no Content-Type header, so the character
+	// encoding is detected from the page alone.
+	body, _, err := htmlcharset.NewReader(br, "")
+	if err != nil {
+		return fmt.Errorf("detecting character encoding failed: %v", err)
+	}
+	meta, err := extractMeta(body, base, readBody)
+	if err != nil {
+		return fmt.Errorf("extracting metadata failed: %v", err)
+	}
+	meta.URL = name
+	results <- meta
+	return nil
+}
+
+// extractMeta reads the metadata of the HTML page in body in a
+// single pass. Relative URLs are resolved against base, which
+// may be nil. Unless readBody is true, it stops at the end of
+// the <head>, so the rest of the page is never downloaded.
+//
+// The title is the text of the <title> element, with entities
+// decoded and runs of whitespace collapsed. If the page has no
+// title, it falls back to the og:title and twitter:title <meta>
+// tags and then to the text of the first <h1>, reading on into
+// the <body> for it if it has to. A page with none of these has
+// an empty title, which is not an error.
+func extractMeta(body io.Reader, base *url.URL, readBody bool) (*pageMeta, error) {
+	// Create a new tokenizer over the response body.
+	tokenizer := html.NewTokenizer(body)
+
+	meta := &pageMeta{
+		OpenGraph: map[string][]string{},
+		Twitter:   map[string][]string{},
+	}
+	var title, h1 string
+	// svgDepth counts the <svg> elements we are in:
+	// an SVG image can have a <title> of its own.
+	svgDepth := 0
+	inHead := true
+	baseSet := false
+
+	// best returns the title we found, or the best fallback
+	// we found, or false if we found nothing yet.
+	best := func() (string, bool) {
+		for _, t := range []string{title, first(meta.OpenGraph["og:title"]), first(meta.Twitter["twitter:title"]), h1} {
+			if len(t) > 0 {
+				return t, true
+			}
+		}
+		return "", false
+	}
+
+	// done reports whether we can stop: we are past the
+	// <head>, with a title, and don't want the <body>.
+	done := func() bool {
+		if readBody || inHead {
+			return false
+		}
+		_, ok := best()
+		return ok
+	}
+
+	// resolve resolves ref against the page URL.
+	resolve := func(ref string) string {
+		ref = strings.TrimSpace(ref)
+		if base == nil || len(ref) == 0 {
+			return ref
+		}
+		u, err := base.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return u.String()
+	}
+
+	for !done() {
+		// Get the next token type.
+		tokenType := tokenizer.Next()
+
+		switch tokenType {
+		case html.ErrorToken:
+			// We either reached the end of the file,
+			// or there was an error reading it.
+			if err := tokenizer.Err(); err != io.EOF {
+				return nil, fmt.Errorf("error tokenizing HTML: %w", err)
+			}
+			meta.Title, _ = best()
+			return meta, nil
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "svg":
+				if svgDepth > 0 {
+					svgDepth--
+				}
+			case "head":
+				// Everything we look for in the <head> is behind us.
+				inHead = false
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if !headTags[token.Data] {
+				// </head> is optional, so this also ends it.
+				inHead = false
+			}
+			switch token.Data {
+			case "html":
+				meta.Lang = strings.TrimSpace(attrValue(token, "lang"))
+			case "base":
+				// Only the first <base> counts.
+				if href := attrValue(token, "href"); !baseSet && len(href) > 0 {
+					baseSet = true
+					if u, err := url.Parse(resolve(href)); err == nil {
+						base = u
+					}
+				}
+			case "svg":
+				if tokenType == html.StartTagToken {
+					svgDepth++
+				}
+			case "title":
+				if svgDepth == 0 && tokenType == html.StartTagToken && len(title) == 0 {
+					title = readText(tokenizer, "title")
+				}
+			case "meta":
+				keys, content := metaKeys(token)
+				for _, key := range keys {
+					var props map[string][]string
+					switch {
+					case key == "description":
+						if len(meta.Description) == 0 {
+							meta.Description = content
+						}
+					case strings.HasPrefix(key, "og:"):
+						props = meta.OpenGraph
+					case strings.HasPrefix(key, "twitter:"):
+						props = meta.Twitter
+					}
+					if props != nil {
+						props[key] = append(props[key], content)
+					}
+				}
+			case "link":
+				rels := strings.Fields(strings.ToLower(attrValue(token, "rel")))
+				href := attrValue(token, "href")
+				if len(href) == 0 {
+					break
+				}
+				for _, rel := range rels {
+					switch rel {
+					case "canonical":
+						if len(meta.Canonical) == 0 {
+							meta.Canonical = resolve(href)
+						}
+					case "icon":
+						// This also matches rel="shortcut icon".
+						if len(meta.Favicon) == 0 {
+							meta.Favicon = resolve(href)
+						}
+					case "alternate":
+						feedType := strings.ToLower(strings.TrimSpace(attrValue(token, "type")))
+						if feedTypes[feedType] {
+							meta.Feeds = append(meta.Feeds, &feedLink{
+								URL:   resolve(href),
+								Type:  feedType,
+								Title: collapseSpace(attrValue(token, "title")),
+							})
+						}
+					}
+				}
+			case "script":
+				scriptType := strings.ToLower(strings.TrimSpace(attrValue(token, "type")))
+				if tokenType == html.StartTagToken && scriptType == "application/ld+json" {
+					if block := readJSON(tokenizer); block != nil {
+						meta.JSONLD = append(meta.JSONLD, block)
+					}
+				}
+			case "h1":
+				if svgDepth == 0 && tokenType == html.StartTagToken && len(h1) == 0 {
+					if _, ok := best(); !ok || readBody {
+						h1 = readText(tokenizer, "h1")
+					}
+				}
+			}
+		}
+	}
+
+	meta.Title, _ = best()
+	return meta, nil
+}
+
+// readText reads the text up to the end tag of the element
+// named tag, including the text of the elements inside it,
+// skipping comments and collapsing whitespace.
+func readText(tokenizer *html.Tokenizer, tag string) string {
+	var text strings.Builder
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return collapseSpace(text.String())
+		case html.TextToken:
+			// Text() decodes entities like &amp; for us.
+			text.Write(tokenizer.Text())
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == tag {
+				return collapseSpace(text.String())
+			}
+		}
+	}
+}
+
+// readJSON reads the text of a <script> element and returns
+// it compacted, or nil if it isn't valid JSON. The tokenizer
+// leaves the text of a <script> as it is, with no entities
+// decoded, which is what we want for JSON.
+func readJSON(tokenizer *html.Tokenizer) json.RawMessage {
+	var text []byte
+	for tokenizer.Next() == html.TextToken {
+		text = append(text, tokenizer.Text()...)
+	}
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, text); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// metaKeys returns the lowercased property and name
+// attributes of a <meta> tag, and its content. Open Graph
+// uses the property attribute and Twitter the name
+// attribute, but pages mix them up, and some set both,
+// in which case the key is only returned once.
+func metaKeys(token html.Token) (keys []string, content string) {
+	for _, attr := range token.Attr {
+		switch attr.Key {
+		case "property", "name":
+			key := strings.ToLower(strings.TrimSpace(attr.Val))
+			if len(key) > 0 && (len(keys) == 0 || keys[0] != key) {
+				keys = append(keys, key)
+			}
+		case "content":
+			content = collapseSpace(attr.Val)
+		}
+	}
+	return keys, content
+}
+
+// attrValue returns the value of the attribute
+// named key, or "" if the token doesn't have it.
+func attrValue(token html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// collapseSpace trims s and replaces each run
+// of whitespace in it with a single space.
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// first returns the first of values, or "" if there are none.
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
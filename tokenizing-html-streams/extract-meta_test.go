@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zicodeng/go-example/htmlcharset"
+)
+
+func TestExtractAll(t *testing.T) {
+	var mx sync.Mutex
+	active, maxActive := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mx.Unlock()
+		defer func() {
+			mx.Lock()
+			active--
+			mx.Unlock()
+		}()
+
+		// Make the first pages the slowest, so they
+		// finish last unless the output is reordered.
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<title>%s</title>", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	URLs := []string{srv.URL + "/slow", srv.URL + "/missing", srv.URL + "/a", srv.URL + "/b"}
+	expected := []struct {
+		title string
+		err   bool
+	}{
+		{"/slow", false},
+		{"", true},
+		{"/a", false},
+		{"/b", false},
+	}
+
+	for i, results := range extractAll(context.Background(), URLs, 2, options{timeout: time.Second}) {
+		result := <-results
+		if _, more := <-results; more {
+			t.Errorf("got more than one result for %s", URLs[i])
+		}
+		if result.URL != URLs[i] {
+			t.Errorf("result %d is for %s, want %s", i, result.URL, URLs[i])
+		}
+		if result.Title != expected[i].title || (len(result.Error) > 0) != expected[i].err {
+			t.Errorf("\ninput: %s\ngot: %q, %q\nwant: %q, error %v", URLs[i], result.Title, result.Error, expected[i].title, expected[i].err)
+		}
+	}
+	if maxActive > 2 {
+		t.Errorf("got %d concurrent requests, want at most 2", maxActive)
+	}
+}
+
+func TestExtractTitle(t *testing.T) {
+	// The first fixtures in testdata/titles mimic the markup of common
+	// real-world pages. The rest reproduce the <head>s of real sites,
+	// trimmed, in the character encodings they are served in.
+	cases := []struct {
+		fixture string
+		want    string
+	}{
+		{"news-article.html", "Markets Rally as Fed Holds Rates — Stocks & Bonds | The Daily Ledger"},
+		{"og-only.html", "Acme Rocket Skates – Size 10"},
+		{"twitter-only.html", "A thread about tokenizers"},
+		{"h1-fallback.html", "Getting Started with html.Tokenizer (permalink)"},
+		{"no-head-tags.html", "Tiny page"},
+		{"uppercase.html", "WELCOME TO MY HOMEPAGE!!!"},
+		{"no-title.html", ""},
+		{"svg-in-head.html", "Dashboard — Settings"},
+		{"title-after-meta.html", "Real <Title>"},
+		{"body-only-h1.html", "Loading…"},
+		{"wikipedia-article.html", "Gödel's incompleteness theorems - Wikipedia"},
+		{"wordpress-post.html", "Why “Third Wave” Coffee Isn’t Just Hype – Beans & Brews"},
+		{"stackoverflow-question.html", `go - How to read a file line by line with "bufio.Scanner" & handle long lines? - Stack Overflow`},
+		{"spa-svg-icons.html", "Trail conditions updated hourly"},
+		{"shift-jis-portal.html", "天気予報・ニュース｜サンプル&ポータル"},
+		{"latin1-shop.html", "Kaffeemühlen & Zubehör – ab 29 € versandkostenfrei | Müller’s Café‐Shop"},
+	}
+
+	for _, c := range cases {
+		f, err := os.Open(filepath.Join("testdata", "titles", c.fixture))
+		if err != nil {
+			t.Fatalf("error opening fixture: %v", err)
+		}
+		// Like a file on the command line, a fixture is
+		// transcoded to UTF-8 from the encoding it declares.
+		body, _, err := htmlcharset.NewReader(f, "")
+		if err != nil {
+			t.Fatalf("\ncase: %s\nerror detecting the encoding: %v", c.fixture, err)
+		}
+		meta, err := extractMeta(body, nil, false)
+		f.Close()
+		if err != nil {
+			t.Errorf("\ncase: %s\nunexpected error: %v", c.fixture, err)
+			continue
+		}
+		if meta.Title != c.want {
+			t.Errorf("\ncase: %s\ngot: %q\nwant: %q", c.fixture, meta.Title, c.want)
+		}
+	}
+}
+
+// errReader fails every read.
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read past the head")
+}
+
+func TestExtractMetaStopsAtHead(t *testing.T) {
+	for _, head := range []string{
+		"<html><head><title>Title</title></head>",
+		"<title>Title</title><p>",
+		`<html><head><meta property="og:title" content="Title"></head>`,
+		`<meta name="twitter:title" content="Title"><body>`,
+	} {
+		// Reading anything after the head is an error.
+		meta, err := extractMeta(io.MultiReader(strings.NewReader(head), errReader{}), nil, false)
+		if err != nil || meta.Title != "Title" {
+			t.Errorf("\ninput: %s\ngot: %+v, %v\nwant: %q", head, meta, err, "Title")
+		}
+	}
+}
+
+func TestExtractMeta(t *testing.T) {
+	base, _ := url.Parse("https://blog.example.com/2018/streaming-html?utm_source=feed")
+	expected := &pageMeta{
+		Title:       "Streaming HTML in Go · Example Blog",
+		Description: "How to pull metadata out of a page without parsing all of it.",
+		Canonical:   "https://blog.example.com/2018/streaming-html",
+		Lang:        "en-GB",
+		Favicon:     "https://blog.example.com/static/favicon.png",
+		OpenGraph: map[string][]string{
+			"og:title":            {"Streaming HTML in Go"},
+			"og:type":             {"article"},
+			"og:image":            {"https://blog.example.com/img/cover.png", "https://blog.example.com/img/second.png"},
+			"og:locale":           {"en_GB"},
+			"og:locale:alternate": {"fr_FR", "de_DE"},
+		},
+		Twitter: map[string][]string{
+			"twitter:card": {"summary_large_image"},
+			"twitter:site": {"@example"},
+		},
+		JSONLD: []json.RawMessage{
+			json.RawMessage(`{"@context":"https://schema.org","@type":"BlogPosting","headline":"Streaming HTML in Go & <friends>"}`),
+		},
+		Feeds: []*feedLink{
+			{"https://blog.example.com/feed.xml", "application/rss+xml", "Example Blog"},
+			{"https://blog.example.com/atom.xml", "application/atom+xml", ""},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		readBody bool
+		jsonLD   []string
+	}{
+		{"head only", false, nil},
+		{"with body", true, []string{`{"@type":"BreadcrumbList"}`}},
+	}
+	for _, c := range cases {
+		f, err := os.Open(filepath.Join("testdata", "meta", "article.html"))
+		if err != nil {
+			t.Fatalf("error opening fixture: %v", err)
+		}
+		got, err := extractMeta(f, base, c.readBody)
+		f.Close()
+		if err != nil {
+			t.Errorf("\ncase: %s\nunexpected error: %v", c.name, err)
+			continue
+		}
+
+		want := *expected
+		want.JSONLD = append([]json.RawMessage{}, expected.JSONLD...)
+		for _, block := range c.jsonLD {
+			want.JSONLD = append(want.JSONLD, json.RawMessage(block))
+		}
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(&want)
+		if !bytes.Equal(gotJSON, wantJSON) {
+			t.Errorf("\ncase: %s\ngot: %s\nwant: %s", c.name, gotJSON, wantJSON)
+		}
+	}
+}
+
+func TestExtractArg(t *testing.T) {
+	fixture := filepath.Join("testdata", "titles", "h1-fallback.html")
+	page, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatalf("error reading fixture: %v", err)
+	}
+	gzipped := filepath.Join(t.TempDir(), "page.html.gz")
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write(page)
+	zw.Close()
+	if err := os.WriteFile(gzipped, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	const title = "Getting Started with html.Tokenizer (permalink)"
+	cases := []struct {
+		arg     string
+		title   string
+		favicon string
+		err     bool
+	}{
+		{fixture, title, "file:///favicon.ico", false},
+		{gzipped, title, "file:///favicon.ico", false},
+		{filepath.Join("testdata", "missing.html"), "", "", true},
+	}
+	for _, c := range cases {
+		results := make(chan *pageMeta, 10)
+		extractArg(context.Background(), c.arg, options{}, results)
+		close(results)
+		var metas []*pageMeta
+		for meta := range results {
+			metas = append(metas, meta)
+		}
+		if len(metas) != 1 {
+			t.Errorf("\ninput: %s\ngot %d results, want 1", c.arg, len(metas))
+			continue
+		}
+		got := metas[0]
+		// URLs in the page resolve against the file.
+		if got.URL != c.arg || got.Title != c.title || got.Favicon != c.favicon || (len(got.Error) > 0) != c.err {
+			t.Errorf("\ninput: %s\ngot: %+v\nwant: title %q, favicon %q, error %v", c.arg, got, c.title, c.favicon, c.err)
+		}
+	}
+}
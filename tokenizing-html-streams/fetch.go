@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zicodeng/go-example/htmlcharset"
+)
+
+// ErrStatus is the error returned when the
+// response status code isn't 200 OK.
+type ErrStatus struct {
+	Code int
+}
+
+func (e *ErrStatus) Error() string {
+	return fmt.Sprintf("response status code was %d", e.Code)
+}
+
+// ErrContentType is the error returned when the
+// response isn't an HTML page.
+type ErrContentType struct {
+	Got string
+}
+
+func (e *ErrContentType) Error() string {
+	return fmt.Sprintf("response content type was %q, not text/html", e.Got)
+}
+
+// ErrTimeout is the error returned when fetching a
+// page took too long. Err is what the timeout
+// interrupted.
+type ErrTimeout struct {
+	Err error
+}
+
+func (e *ErrTimeout) Error() string {
+	return fmt.Sprintf("timed out: %v", e.Err)
+}
+
+func (e *ErrTimeout) Unwrap() error {
+	return e.Err
+}
+
+// timeoutError returns err as an *ErrTimeout if
+// it happened because the deadline of ctx passed
+// or the network timed out, or err otherwise.
+func timeoutError(ctx context.Context, err error) error {
+	var netErr net.Error
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return &ErrTimeout{err}
+	}
+	return err
+}
+
+// fetchHTML fetches the provided URL and returns the response body or an error.
+// The error is an *ErrStatus, *ErrContentType or *ErrTimeout when the page
+// couldn't be fetched for one of those reasons. The fetch is abandoned when
+// ctx is done, and so is reading the body.
+func fetchHTML(ctx context.Context, URL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request failed: %v", err)
+	}
+
+	// Fetch the URL.
+	// Do() returns a pointer to an http.Response struct and potentially an error.
+	// If there is an error, there is no response, and nothing to close.
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+
+	// Verify response status code.
+	// From here on, close the body if we don't return it.
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, &ErrStatus{res.StatusCode}
+	}
+
+	// Verify response content type
+	contentType := res.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "text/html") {
+		res.Body.Close()
+		return nil, &ErrContentType{contentType}
+	}
+
+	// The tokenizer only understands UTF-8, so transcode
+	// pages in other character encodings to UTF-8 first.
+	body, _, err := htmlcharset.NewReader(res.Body, contentType)
+	if err != nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("detecting character encoding failed: %w", timeoutError(ctx, err))
+	}
+
+	// Return without error. The reader doesn't need closing,
+	// so close the response body when it's done with.
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, res.Body}, nil
+}
+
+// fetchMeta fetches the metadata of the page at URL.
+// Errors from fetchHTML are wrapped, not replaced,
+// so callers can still inspect them with errors.As.
+func fetchMeta(ctx context.Context, URL string, readBody bool) (*pageMeta, error) {
+	base, err := url.Parse(URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL failed: %v", err)
+	}
+
+	body, err := fetchHTML(ctx, URL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching URL failed: %w", err)
+	}
+
+	// Close the response body after we are done with it.
+	// The statement is executed at the end of its enclosing function (fetchMeta).
+	defer body.Close()
+
+	meta, err := extractMeta(body, base, readBody)
+	if err != nil {
+		// The deadline can pass while we read the body.
+		return nil, fmt.Errorf("extracting metadata failed: %w", timeoutError(ctx, err))
+	}
+
+	return meta, nil
+}
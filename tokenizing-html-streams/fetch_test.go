@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "<title>OK</title>")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		case "/error":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case "/slow":
+			// Wait for the client to give up.
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name  string
+		URL   string
+		check func(err error) bool
+	}{
+		{"ok", srv.URL + "/ok", func(err error) bool { return err == nil }},
+		{"not found", srv.URL + "/missing", func(err error) bool {
+			var e *ErrStatus
+			return errors.As(err, &e) && e.Code == http.StatusNotFound
+		}},
+		{"server error", srv.URL + "/error", func(err error) bool {
+			var e *ErrStatus
+			return errors.As(err, &e) && e.Code == http.StatusInternalServerError
+		}},
+		{"not html", srv.URL + "/image", func(err error) bool {
+			var e *ErrContentType
+			return errors.As(err, &e) && e.Got == "image/png"
+		}},
+		{"timeout", srv.URL + "/slow", func(err error) bool {
+			var e *ErrTimeout
+			return errors.As(err, &e) && errors.Is(err, context.DeadlineExceeded)
+		}},
+		{"connection refused", "http://127.0.0.1:1/", func(err error) bool {
+			var e *ErrTimeout
+			return err != nil && !errors.As(err, &e)
+		}},
+		{"invalid URL", "http://a b.com/", func(err error) bool { return err != nil }},
+	}
+
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		body, err := fetchHTML(ctx, c.URL)
+		if !c.check(err) {
+			t.Errorf("\ncase: %s\nunexpected error: %v", c.name, err)
+		}
+		if (body == nil) != (err != nil) {
+			t.Errorf("\ncase: %s\ngot body %v with error %v", c.name, body, err)
+		}
+		if body != nil {
+			body.Close()
+		}
+		cancel()
+	}
+}
+
+func TestFetchHTMLCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("got a request after the context was canceled")
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := fetchHTML(ctx, srv.URL)
+	var e *ErrTimeout
+	if !errors.Is(err, context.Canceled) || errors.As(err, &e) {
+		t.Errorf("got %v, want a context.Canceled error that isn't a timeout", err)
+	}
+}
+
+func TestFetchMetaTimeout(t *testing.T) {
+	// The deadline passes while the body is being read.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head><meta charset=utf-8>")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := fetchMeta(ctx, srv.URL, false)
+	var e *ErrTimeout
+	if !errors.As(err, &e) {
+		t.Errorf("got %v, want an *ErrTimeout", err)
+	}
+}
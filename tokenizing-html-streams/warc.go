@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/zicodeng/go-example/htmlcharset"
+)
+
+// warcMagic starts every WARC record.
+const warcMagic = "WARC/"
+
+// warcRecord is one record of a WARC archive: its
+// named header fields and its content block.
+type warcRecord struct {
+	Header textproto.MIMEHeader
+	Block  io.Reader
+}
+
+// warcReader reads the records of a WARC archive in turn.
+// See https://iipc.github.io/warc-specifications/ for the format.
+type warcReader struct {
+	r     *textproto.Reader
+	block *io.LimitedReader
+}
+
+// newWARCReader constructs a new warcReader reading from r,
+// which must already be decompressed.
+func newWARCReader(r *bufio.Reader) *warcReader {
+	return &warcReader{r: textproto.NewReader(r)}
+}
+
+// Next returns the next record of the archive, or io.EOF
+// after the last one. Reading the next record discards
+// whatever is left of the block of the previous one.
+func (wr *warcReader) Next() (*warcRecord, error) {
+	if wr.block != nil {
+		if _, err := io.Copy(io.Discard, wr.block); err != nil {
+			return nil, fmt.Errorf("error reading WARC record: %v", err)
+		}
+	}
+
+	// Records are separated by blank lines.
+	var version string
+	for len(version) == 0 {
+		line, err := wr.r.ReadLine()
+		if err != nil {
+			// io.EOF here means there are no more records.
+			return nil, err
+		}
+		version = strings.TrimSpace(line)
+	}
+	if !strings.HasPrefix(version, warcMagic) {
+		return nil, fmt.Errorf("error reading WARC record: got %q, want a WARC version line", version)
+	}
+
+	header, err := wr.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("error reading WARC header: %v", err)
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("error reading WARC header: invalid Content-Length %q", header.Get("Content-Length"))
+	}
+
+	wr.block = &io.LimitedReader{R: wr.r.R, N: length}
+	return &warcRecord{header, wr.block}, nil
+}
+
+// readWARC extracts the metadata of each HTML page in the
+// WARC archive in r, sending it on results. Only response
+// records of successful HTML responses are pages: requests,
+// redirects, images and the like are skipped.
+func readWARC(r *bufio.Reader, readBody bool, results chan<- *pageMeta) error {
+	wr := newWARCReader(r)
+	for {
+		record, err := wr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Header.Get("WARC-Type") != "response" ||
+			!strings.HasPrefix(record.Header.Get("Content-Type"), "application/http") {
+			continue
+		}
+
+		// Some WARC 1.0 writers put the URI in angle brackets.
+		URL := strings.Trim(record.Header.Get("WARC-Target-URI"), "<>")
+		meta, err := extractRecord(record, URL, readBody)
+		if err != nil {
+			results <- &pageMeta{URL: URL, Error: err.Error()}
+			continue
+		}
+		if meta != nil {
+			meta.URL = URL
+			results <- meta
+		}
+	}
+}
+
+// extractRecord extracts the metadata of the page in a WARC
+// response record. It returns nil if the record isn't a page.
+func extractRecord(record *warcRecord, URL string, readBody bool) (*pageMeta, error) {
+	// The block of a response record is the HTTP
+	// response, exactly as it came over the wire.
+	res, err := http.ReadResponse(bufio.NewReader(record.Block), nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading response failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	contentType := res.Header.Get("Content-Type")
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(contentType, "text/html") {
+		return nil, nil
+	}
+
+	// Unlike an http.Client, ReadResponse
+	// doesn't undo any compression.
+	var body io.Reader = res.Body
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing response failed: %v", err)
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	body, _, err = htmlcharset.NewReader(body, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("detecting character encoding failed: %v", err)
+	}
+
+	base, _ := url.Parse(URL)
+	meta, err := extractMeta(body, base, readBody)
+	if err != nil {
+		return nil, fmt.Errorf("extracting metadata failed: %v", err)
+	}
+	return meta, nil
+}
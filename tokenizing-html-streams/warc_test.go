@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// warcRecordBytes returns a WARC record of type warcType
+// for URI, with block as its content.
+func warcRecordBytes(warcType, URI, contentType, block string) []byte {
+	return []byte(fmt.Sprintf("WARC/1.0\r\n"+
+		"WARC-Type: %s\r\n"+
+		"WARC-Target-URI: %s\r\n"+
+		"WARC-Date: 2018-01-02T03:04:05Z\r\n"+
+		"Content-Type: %s\r\n"+
+		"Content-Length: %d\r\n"+
+		"\r\n%s\r\n\r\n", warcType, URI, contentType, len(block), block))
+}
+
+// httpResponse returns a raw HTTP response.
+func httpResponse(status, contentType, headers, body string) string {
+	return fmt.Sprintf("HTTP/1.1 %s\r\nContent-Type: %s\r\n%sContent-Length: %d\r\n\r\n%s",
+		status, contentType, headers, len(body), body)
+}
+
+func TestReadWARC(t *testing.T) {
+	gzipped := &bytes.Buffer{}
+	zw := gzip.NewWriter(gzipped)
+	fmt.Fprint(zw, `<title>Compressed</title>`)
+	zw.Close()
+
+	const msgType = "application/http; msgtype=response"
+	records := [][]byte{
+		warcRecordBytes("warcinfo", "", "application/warc-fields", "software: test\r\n"),
+		warcRecordBytes("request", "http://a.com/", "application/http; msgtype=request",
+			"GET / HTTP/1.1\r\nHost: a.com\r\n\r\n"),
+		warcRecordBytes("response", "http://a.com/", msgType,
+			httpResponse("200 OK", "text/html", "", `<title>A</title><link rel="icon" href="/a.ico">`)),
+		warcRecordBytes("response", "http://a.com/logo.png", msgType,
+			httpResponse("200 OK", "image/png", "", "\x89PNG")),
+		warcRecordBytes("response", "http://a.com/old", msgType,
+			httpResponse("301 Moved Permanently", "text/html", "Location: /\r\n", "")),
+		warcRecordBytes("response", "<http://b.com/>", msgType,
+			httpResponse("200 OK", "text/html; charset=utf-8", "Content-Encoding: gzip\r\n", gzipped.String())),
+		warcRecordBytes("response", "http://c.com/", msgType, "not HTTP"),
+	}
+	expected := []*pageMeta{
+		{URL: "http://a.com/", Title: "A", Favicon: "http://a.com/a.ico"},
+		{URL: "http://b.com/", Title: "Compressed"},
+		{URL: "http://c.com/", Error: "error"},
+	}
+
+	// A .warc.gz has a gzip stream for each record.
+	plain, compressed := &bytes.Buffer{}, &bytes.Buffer{}
+	for _, record := range records {
+		plain.Write(record)
+		zw := gzip.NewWriter(compressed)
+		zw.Write(record)
+		zw.Close()
+	}
+
+	for name, archive := range map[string][]byte{"warc": plain.Bytes(), "warc.gz": compressed.Bytes()} {
+		results := make(chan *pageMeta, len(records))
+		if err := readFile(name, bytes.NewReader(archive), nil, false, results); err != nil {
+			t.Errorf("\ncase: %s\nunexpected error: %v", name, err)
+			continue
+		}
+		close(results)
+		i := 0
+		for got := range results {
+			if i >= len(expected) {
+				t.Errorf("\ncase: %s\nunexpected result: %+v", name, got)
+				continue
+			}
+			want := expected[i]
+			if got.URL != want.URL || got.Title != want.Title || got.Favicon != want.Favicon ||
+				(len(got.Error) > 0) != (len(want.Error) > 0) {
+				t.Errorf("\ncase: %s\ngot: %+v\nwant: %+v", name, got, want)
+			}
+			i++
+		}
+		if i != len(expected) {
+			t.Errorf("\ncase: %s\ngot %d pages, want %d", name, i, len(expected))
+		}
+	}
+}
+
+func TestWARCReaderErrors(t *testing.T) {
+	for _, input := range []string{
+		"WARC/1.0\r\nWARC-Type: response\r\n\r\n",
+		"WARC/1.0\r\nContent-Length: -1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\n\r\n",
+	} {
+		wr := newWARCReader(bufio.NewReader(strings.NewReader(input)))
+		if _, err := wr.Next(); err == nil {
+			t.Errorf("\ninput: %q\ngot no error, want one", input)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// CachedPage is what we keep of a crawled page so that
+// the next crawl can make a conditional request for it.
+type CachedPage struct {
+	// ETag and LastModified are the validators
+	// from the response headers.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// PL is what we extracted from the page, which
+	// is still right if the server says it is not modified.
+	PL *PageLinks `json:"pageLinks"`
+}
+
+// PageCache holds the CachedPages of a crawl, by URL. It is
+// loaded from a file and saved back to it once the crawl is
+// over, so the pages that haven't changed since the last crawl
+// don't have to be downloaded again. It is safe for concurrent use.
+type PageCache struct {
+	path string
+
+	mx    sync.Mutex
+	pages map[string]*CachedPage
+}
+
+// NewPageCache constructs a new in-memory PageCache.
+func NewPageCache() *PageCache {
+	return &PageCache{pages: map[string]*CachedPage{}}
+}
+
+// OpenPageCache loads the PageCache saved at path,
+// or starts an empty one if the file doesn't exist.
+func OpenPageCache(path string) (*PageCache, error) {
+	pc := NewPageCache()
+	pc.path = path
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return pc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening page cache: %v", err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&pc.pages); err != nil {
+		return nil, fmt.Errorf("error reading page cache: %v", err)
+	}
+	return pc, nil
+}
+
+// Get returns the cached page for URL, or nil.
+func (pc *PageCache) Get(URL string) *CachedPage {
+	pc.mx.Lock()
+	defer pc.mx.Unlock()
+	return pc.pages[URL]
+}
+
+// Put caches page for URL.
+func (pc *PageCache) Put(URL string, page *CachedPage) {
+	pc.mx.Lock()
+	defer pc.mx.Unlock()
+	pc.pages[URL] = page
+}
+
+// Save writes the cache back to the file it was opened from.
+// It does nothing for an in-memory cache.
+func (pc *PageCache) Save() error {
+	if len(pc.path) == 0 {
+		return nil
+	}
+	pc.mx.Lock()
+	defer pc.mx.Unlock()
+
+	// Write to a temporary file and rename it over the old
+	// one, so a crash never leaves a partial cache.
+	tmp, err := os.Create(pc.path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating page cache: %v", err)
+	}
+	if err := json.NewEncoder(tmp).Encode(pc.pages); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing page cache: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing page cache: %v", err)
+	}
+	if err := os.Rename(pc.path+".tmp", pc.path); err != nil {
+		return fmt.Errorf("error replacing page cache: %v", err)
+	}
+	return nil
+}
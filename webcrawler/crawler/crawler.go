@@ -0,0 +1,545 @@
+// Package crawler implements a concurrent, polite web crawler.
+package crawler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+// Default settings used by New when the
+// corresponding Config field is left zero.
+const (
+	// defaultWorkers is the number of worker goroutines. Workers
+	// are only given jobs for hosts with a free slot, so it can be
+	// much larger than PerHost: it only caps the requests across
+	// all hosts.
+	defaultWorkers            = 100
+	defaultPerHost            = 2
+	defaultQueueSize          = 10000
+	defaultCheckpointInterval = 30 * time.Second
+)
+
+// maxSitemaps is the most sitemap files we read when seeding,
+// so a sitemap index can't keep us from ever starting.
+const maxSitemaps = 1000
+
+// Job is a URL to crawl.
+type Job struct {
+	URL string `json:"url"`
+	// Depth is the number of links between
+	// the starting URL and this one.
+	Depth int `json:"depth"`
+	// LastMod and Priority are set for jobs seeded from
+	// a sitemap that gives them. Priority ranges from 0 to 1,
+	// and orders the jobs of the same depth.
+	LastMod  *time.Time `json:"lastmod,omitempty"`
+	Priority float64    `json:"priority,omitempty"`
+}
+
+// JobResult is the outcome of crawling a Job.
+type JobResult struct {
+	URL   string
+	Depth int
+	PL    *PageLinks
+	Error error
+	// Status is the HTTP status code,
+	// or 0 if we didn't get a response.
+	Status int
+	// FetchedAt is when the fetch started
+	// and Duration is how long it took.
+	FetchedAt time.Time
+	Duration  time.Duration
+
+	// skipped is set when the crawl was canceled before the
+	// job was fetched, so it should stay in the frontier.
+	skipped bool
+}
+
+// Config holds the settings for a Crawler.
+type Config struct {
+	// Seeds are the URLs to start crawling from. Seeds that
+	// are already in the Frontier are skipped, so the same
+	// Config can be used to resume a crawl.
+	Seeds []string
+	// Sitemaps are sitemap URLs whose pages are added as seeds,
+	// if they are in Scope. Sitemap indexes are followed. If
+	// RobotsSitemaps is set, the sitemaps listed in the robots.txt
+	// file of each seed's host are used too.
+	Sitemaps       []string
+	RobotsSitemaps bool
+	// Scope decides which links are followed.
+	Scope *Scope
+	// PerHost is the number of concurrent requests to the same
+	// host. It is the main throttle: Workers only caps the number
+	// of pages fetched concurrently across all hosts.
+	PerHost int
+	Workers int
+	// QueueSize is the number of jobs kept in memory. Jobs
+	// that don't fit stay in the Frontier until there's room.
+	QueueSize int
+	// Robots, if set, is used to obey robots.txt.
+	Robots *RobotsCache
+	// Limiter spaces out requests to each host.
+	Limiter *HostLimiter
+	// Fetcher gets the pages.
+	Fetcher *Fetcher
+	// Frontier holds the crawl state. If it is persistent, it is
+	// checkpointed every CheckpointInterval and when Run returns.
+	Frontier           *Frontier
+	CheckpointInterval time.Duration
+	// Sinks receive every JobResult. They are not closed by Run.
+	Sinks []Sink
+	// Metrics, if set, is kept up to date with the progress
+	// of the crawl. Give it to the Fetcher too, to count
+	// bytes and latency.
+	Metrics *Metrics
+	// Logger gets the crawl's log lines. Pages are
+	// logged at the Debug level, and errors at Warn.
+	Logger *slog.Logger
+}
+
+// Crawler crawls the web starting from a set of seed URLs.
+type Crawler struct {
+	cfg   Config
+	queue *jobQueue
+	// inMemory holds the page keys of pending jobs that are in
+	// the queue or being fetched. spilled is the number of
+	// pending jobs that didn't fit and are only in the Frontier.
+	inMemory map[string]bool
+	spilled  int
+}
+
+// New constructs a new Crawler. Without a Scope it follows
+// every link; keep in mind that a Scope's zero MaxDepth means
+// no limit too, and SeedsOnly only crawls cfg.Seeds.
+func New(cfg Config) *Crawler {
+	if cfg.Scope == nil {
+		cfg.Scope = &Scope{Domains: []string{anyDomain}}
+	}
+	if cfg.PerHost <= 0 {
+		cfg.PerHost = defaultPerHost
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.Limiter == nil {
+		cfg.Limiter = NewHostLimiter(0, cfg.PerHost)
+	}
+	if cfg.Fetcher == nil {
+		cfg.Fetcher = NewFetcher(FetcherConfig{MaxConnsPerHost: cfg.PerHost, Metrics: cfg.Metrics})
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Frontier == nil {
+		cfg.Frontier = NewFrontier()
+	}
+	if cfg.CheckpointInterval <= 0 {
+		cfg.CheckpointInterval = defaultCheckpointInterval
+	}
+	return &Crawler{
+		cfg:      cfg,
+		queue:    newJobQueue(cfg.QueueSize),
+		inMemory: map[string]bool{},
+	}
+}
+
+// Run crawls until there is nothing left to crawl or ctx is done.
+// Once ctx is done no new pages are started, but the pages being
+// fetched are finished and reported, so they aren't lost. Pages
+// waiting to be retried are given up on and left pending. Run
+// returns ctx's error if it was interrupted, in which case the
+// pending jobs are left in the Frontier.
+func (c *Crawler) Run(ctx context.Context) error {
+	if err := c.seed(ctx); err != nil {
+		return err
+	}
+
+	jobs := make(chan *Job)
+	// Buffer a result per worker, so workers never wait on us.
+	results := make(chan *JobResult, c.cfg.Workers)
+	for i := 0; i < c.cfg.Workers; i++ {
+		go c.work(ctx, jobs, results)
+	}
+	defer close(jobs)
+
+	ticker := time.NewTicker(c.cfg.CheckpointInterval)
+	defer ticker.Stop()
+
+	// active counts the requests in flight to each host, so we
+	// only hand out jobs for hosts that have a free slot. A worker
+	// given a job for a busy host would wait in the Limiter, and
+	// with enough of those the other hosts would get no workers.
+	active := map[string]int{}
+	busy := func(host string) bool {
+		return active[host] >= c.cfg.PerHost
+	}
+
+	var runErr error
+	var next *Job
+	done := ctx.Done()
+	stopping := false
+	inFlight := 0
+	for {
+		// select picks at random among ready cases, so check
+		// ctx first to avoid starting pages after it is done.
+		if done != nil && ctx.Err() != nil {
+			c.cfg.Logger.Info("stopping, waiting for the pages being fetched", "inFlight", inFlight)
+			done = nil
+			stopping = true
+		}
+		if next == nil && !stopping {
+			next = c.queue.Next(busy)
+			if next == nil && c.spilled > 0 && !c.queue.Full() {
+				c.refill()
+				next = c.queue.Next(busy)
+			}
+		}
+		if c.cfg.Metrics != nil {
+			c.cfg.Metrics.setQueue(c.queue.Len()+c.spilled, inFlight)
+		}
+		if inFlight == 0 && (stopping || next == nil) {
+			break
+		}
+
+		// Only offer a job to the workers if we have one and
+		// aren't stopping: sending on a nil channel never proceeds.
+		var toFetch chan<- *Job
+		if next != nil && !stopping {
+			toFetch = jobs
+		}
+
+		select {
+		case toFetch <- next:
+			active[jobHost(next.URL)]++
+			next = nil
+			inFlight++
+		case result := <-results:
+			inFlight--
+			host := jobHost(result.URL)
+			active[host]--
+			if active[host] == 0 {
+				delete(active, host)
+			}
+			c.queue.Unpark(host)
+			if err := c.handle(result); err != nil {
+				runErr = err
+				stopping = true
+			}
+		case <-ticker.C:
+			if err := c.cfg.Frontier.Checkpoint(); err != nil {
+				runErr = err
+				stopping = true
+			}
+		case <-done:
+			c.cfg.Logger.Info("stopping, waiting for the pages being fetched", "inFlight", inFlight)
+			// A closed channel is always ready, so stop selecting on it.
+			done = nil
+			stopping = true
+		}
+	}
+
+	if err := c.cfg.Frontier.Checkpoint(); err != nil && runErr == nil {
+		runErr = err
+	}
+	if runErr == nil {
+		runErr = ctx.Err()
+	}
+	return runErr
+}
+
+// seed queues the jobs left pending in the Frontier by an
+// earlier crawl, and the seeds and sitemap pages we haven't seen.
+func (c *Crawler) seed(ctx context.Context) error {
+	c.spilled = c.cfg.Frontier.NumPending()
+	c.refill()
+	for _, seed := range c.cfg.Seeds {
+		u, err := url.Parse(seed)
+		if err != nil || !u.IsAbs() {
+			return errors.New("invalid seed URL " + seed)
+		}
+		job := &Job{URL: fetchURL(u)}
+		if c.cfg.Frontier.Seen(job.URL) {
+			continue
+		}
+		if err := c.enqueue(job); err != nil {
+			return err
+		}
+	}
+	return c.seedSitemaps(ctx)
+}
+
+// seedSitemaps queues the pages listed in the sitemaps.
+// A sitemap we can't read is logged and skipped.
+func (c *Crawler) seedSitemaps(ctx context.Context) error {
+	toRead := append([]string{}, c.cfg.Sitemaps...)
+	if c.cfg.RobotsSitemaps {
+		robots := c.cfg.Robots
+		if robots == nil {
+			// We aren't obeying robots.txt, but can still read it.
+			robots = NewRobotsCache(DefaultUserAgent)
+		}
+		for _, seed := range c.cfg.Seeds {
+			if u, err := url.Parse(seed); err == nil {
+				toRead = append(toRead, robots.Sitemaps(ctx, u)...)
+			}
+		}
+	}
+
+	read := map[string]bool{}
+	for len(toRead) > 0 && len(read) < maxSitemaps {
+		sitemapURL := toRead[0]
+		toRead = toRead[1:]
+		if read[sitemapURL] {
+			continue
+		}
+		read[sitemapURL] = true
+
+		sitemap, err := c.getSitemap(ctx, sitemapURL)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.cfg.Logger.Warn("error reading sitemap", "url", sitemapURL, "err", err)
+			continue
+		}
+		// Sitemap indexes list more sitemaps to read.
+		toRead = append(toRead, sitemap.Sitemaps...)
+		added := 0
+		for _, job := range sitemap.Pages {
+			ok, err := c.seedPage(job)
+			if err != nil {
+				return err
+			}
+			if ok {
+				added++
+			}
+		}
+		c.cfg.Logger.Info("read sitemap", "url", sitemapURL, "pages", len(sitemap.Pages), "added", added)
+	}
+	return nil
+}
+
+// getSitemap fetches a sitemap, sharing the politeness
+// limits of the host with the pages we crawl.
+func (c *Crawler) getSitemap(ctx context.Context, sitemapURL string) (*Sitemap, error) {
+	u, err := url.Parse(sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	done, err := c.cfg.Limiter.Wait(ctx, u.Host, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return c.cfg.Fetcher.GetSitemap(ctx, sitemapURL)
+}
+
+// seedPage queues a page from a sitemap at depth 0, and reports
+// whether it did: the page must be in scope and not seen yet.
+func (c *Crawler) seedPage(job *Job) (bool, error) {
+	scope := c.cfg.Scope
+	if scope.MaxPages > 0 && c.cfg.Frontier.Queued() >= scope.MaxPages {
+		return false, nil
+	}
+	u, err := url.Parse(job.URL)
+	if err != nil || !u.IsAbs() || !scope.Allows(u, 0) {
+		return false, nil
+	}
+	job.URL = fetchURL(u)
+	job.Depth = 0
+	if c.cfg.Frontier.Seen(job.URL) {
+		return false, nil
+	}
+	return true, c.enqueue(job)
+}
+
+// enqueue adds a new job to the Frontier and the queue.
+func (c *Crawler) enqueue(job *Job) error {
+	if err := c.cfg.Frontier.Add(job); err != nil {
+		return err
+	}
+	c.push(job)
+	return nil
+}
+
+// push puts a pending job in the queue, or leaves it
+// spilled in the Frontier if the queue is full.
+func (c *Crawler) push(job *Job) {
+	if c.queue.Push(job) {
+		c.inMemory[pageKey(job.URL)] = true
+	} else {
+		c.spilled++
+	}
+}
+
+// refill moves spilled jobs from the Frontier back into the queue.
+func (c *Crawler) refill() {
+	for !c.queue.Full() {
+		job := c.cfg.Frontier.Next()
+		if job == nil {
+			// Nothing was left to load.
+			c.spilled = 0
+			return
+		}
+		// Jobs that went straight into the queue
+		// are still waiting in the Frontier too.
+		if c.inMemory[pageKey(job.URL)] {
+			continue
+		}
+		c.push(job)
+		c.spilled--
+	}
+}
+
+// work fetches the jobs it receives until jobs is closed.
+func (c *Crawler) work(ctx context.Context, jobs <-chan *Job, results chan<- *JobResult) {
+	for job := range jobs {
+		results <- c.fetch(ctx, job)
+	}
+}
+
+// fetch crawls a single job.
+func (c *Crawler) fetch(ctx context.Context, job *Job) *JobResult {
+	result := &JobResult{URL: job.URL, Depth: job.Depth}
+	u, err := url.Parse(job.URL)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	var delay time.Duration
+	if c.cfg.Robots != nil {
+		rules, err := c.cfg.Robots.Rules(ctx, u)
+		if err != nil {
+			result.Error = err
+			result.skipped = true
+			return result
+		}
+		if !rules.Allowed(c.cfg.Robots.userAgent, u) {
+			result.Error = ErrRobotsDisallowed
+			return result
+		}
+		delay = rules.CrawlDelay(c.cfg.Robots.userAgent)
+	}
+	done, err := c.cfg.Limiter.Wait(ctx, u.Host, delay)
+	if err != nil {
+		result.Error = err
+		result.skipped = true
+		return result
+	}
+	defer done()
+
+	c.cfg.Logger.Debug("crawling", "url", job.URL, "depth", job.Depth)
+	result.FetchedAt = time.Now()
+	result.PL, result.Status, result.Error = c.cfg.Fetcher.GetPageLinks(ctx, job.URL)
+	result.Duration = time.Since(result.FetchedAt)
+	// If ctx was canceled while we waited to retry, we
+	// never got the page, so it's left in the frontier.
+	if result.Error != nil && ctx.Err() != nil && errors.Is(result.Error, ctx.Err()) {
+		result.skipped = true
+	}
+	return result
+}
+
+// handle processes a JobResult: it reports it to the sinks
+// and queues the links found in the page.
+func (c *Crawler) handle(result *JobResult) error {
+	if result.skipped {
+		// Leave it pending in the Frontier.
+		delete(c.inMemory, pageKey(result.URL))
+		return nil
+	}
+	if c.cfg.Metrics != nil {
+		c.cfg.Metrics.observeResult(result)
+	}
+	for _, sink := range c.cfg.Sinks {
+		if err := sink.Write(result); err != nil {
+			return err
+		}
+	}
+
+	if result.Error != nil {
+		c.cfg.Logger.Warn("error crawling", "url", result.URL, "status", result.Status, "err", result.Error)
+	} else if dup, err := c.isDuplicate(result); err != nil {
+		return err
+	} else if dup {
+		c.cfg.Logger.Info("skipping duplicate", "url", result.URL, "canonical", result.PL.Canonical)
+	} else {
+		c.cfg.Logger.Info("crawled", "url", result.URL, "status", result.Status,
+			"links", len(result.PL.Links), "duration", result.Duration)
+		if err := c.follow(result); err != nil {
+			return err
+		}
+	}
+
+	// Only mark the job done once its links are in the
+	// frontier, so a crash in between crawls it again
+	// rather than losing its links.
+	delete(c.inMemory, pageKey(result.URL))
+	return c.cfg.Frontier.Done(result.URL)
+}
+
+// follow queues the links in result that are in scope
+// and haven't been seen yet.
+func (c *Crawler) follow(result *JobResult) error {
+	scope := c.cfg.Scope
+	for _, l := range result.PL.Links {
+		// Respect pages asking us not to follow a link, and
+		// only crawl pages: assets would use up MaxPages.
+		if l.NoFollow || !l.isPage() {
+			continue
+		}
+		// Once we've queued MaxPages, stop adding more,
+		// but keep going until the queued ones are done.
+		if scope.MaxPages > 0 && c.cfg.Frontier.Queued() >= scope.MaxPages {
+			return nil
+		}
+		link, err := url.Parse(l.URL)
+		if err != nil || !scope.Allows(link, result.Depth+1) {
+			continue
+		}
+		URL := fetchURL(link)
+		if c.cfg.Frontier.Seen(URL) {
+			continue
+		}
+		c.cfg.Logger.Debug("queued", "url", URL, "depth", result.Depth+1)
+		if err := c.enqueue(&Job{URL: URL, Depth: result.Depth + 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDuplicate reports whether the page in result declares a
+// canonical URL that we have already queued. If it doesn't,
+// the canonical URL is marked as seen so we won't crawl it.
+func (c *Crawler) isDuplicate(result *JobResult) (bool, error) {
+	if len(result.PL.Canonical) == 0 {
+		return false, nil
+	}
+	canonical, err := NormalizeURLString(result.PL.Canonical)
+	if err != nil || canonical == pageKey(result.URL) {
+		return false, nil
+	}
+	if c.cfg.Frontier.Seen(canonical) {
+		return true, nil
+	}
+	return false, c.cfg.Frontier.MarkSeen(canonical)
+}
+
+// fetchURL returns the URL to fetch for a link: the link
+// as it was written, less the fragment, which only points
+// within the page. It is normalized only to dedupe it.
+func fetchURL(u *url.URL) string {
+	f := *u
+	f.Fragment = ""
+	f.RawFragment = ""
+	return f.String()
+}
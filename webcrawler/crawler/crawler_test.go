@@ -0,0 +1,497 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// collectSink records the URLs of the results it is given.
+type collectSink struct {
+	urls []string
+}
+
+func (cs *collectSink) Write(result *JobResult) error {
+	cs.urls = append(cs.urls, result.URL)
+	return nil
+}
+
+func (cs *collectSink) Close() error {
+	return nil
+}
+
+// newSite starts a test server serving the given pages,
+// mapping each path to the paths it links to.
+func newSite(t *testing.T, pages map[string][]string) *httptest.Server {
+	mux := http.NewServeMux()
+	for path, links := range pages {
+		links := links
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html><body>")
+			for _, link := range links {
+				fmt.Fprintf(w, `<a href="%s">%s</a>`, link, link)
+			}
+			fmt.Fprint(w, "</body></html>")
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCrawlerRun(t *testing.T) {
+	srv := newSite(t, map[string][]string{
+		"/":  {"/a", "/b", "http://example.com/"},
+		"/a": {"/", "/b", "/c"},
+		"/b": {"/a?utm_source=x", "/missing"},
+		"/c": {"/d"},
+		"/d": {},
+	})
+
+	cases := []struct {
+		name  string
+		scope *Scope
+		want  []string
+	}{
+		{
+			name:  "whole site",
+			scope: &Scope{Domains: []string{"127.0.0.1"}},
+			want:  []string{"/", "/a", "/b", "/c", "/d", "/missing"},
+		},
+		{
+			name:  "max depth",
+			scope: &Scope{Domains: []string{"127.0.0.1"}, MaxDepth: 1},
+			want:  []string{"/", "/a", "/b"},
+		},
+		{
+			name:  "seed only",
+			scope: &Scope{Domains: []string{"127.0.0.1"}, MaxDepth: SeedsOnly},
+			want:  []string{"/"},
+		},
+	}
+
+	for _, c := range cases {
+		sink := &collectSink{}
+		crawler := New(Config{
+			Seeds:     []string{srv.URL + "/"},
+			Scope:     c.scope,
+			Workers:   3,
+			QueueSize: 2,
+			Sinks:     []Sink{sink},
+		})
+		if err := crawler.Run(context.Background()); err != nil {
+			t.Fatalf("\ncase: %s\nunexpected error: %v", c.name, err)
+		}
+		got := make([]string, len(sink.urls))
+		for i, URL := range sink.urls {
+			got[i] = URL[len(srv.URL):]
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("\ncase: %s\ngot: %v\nwant: %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCrawlerTrailingSlash(t *testing.T) {
+	// /docs/ and /docs are the same page once normalized, but
+	// the server only serves the first, and relative links on
+	// it only resolve under /docs/.
+	srv := newSite(t, map[string][]string{
+		"/":                {"/docs/"},
+		"/docs/":           {"intro.html"},
+		"/docs/intro.html": {},
+	})
+
+	graph := NewLinkGraph()
+	sink := &collectSink{}
+	crawler := New(Config{
+		Seeds: []string{srv.URL + "/"},
+		Scope: &Scope{Domains: []string{"127.0.0.1"}},
+		Sinks: []Sink{sink, graph},
+	})
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sort.Strings(sink.urls)
+	want := []string{srv.URL + "/", srv.URL + "/docs/", srv.URL + "/docs/intro.html"}
+	if !reflect.DeepEqual(sink.urls, want) {
+		t.Errorf("got results for %v, want %v", sink.urls, want)
+	}
+	var report strings.Builder
+	if err := graph.WriteBrokenLinks(&report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Count(report.String(), "\n"); got != 1 {
+		t.Errorf("got broken links:\n%s\nwant none", report.String())
+	}
+}
+
+func TestCrawlerCanonical(t *testing.T) {
+	page := func(canonical string, links ...string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html><head>")
+			if len(canonical) > 0 {
+				fmt.Fprintf(w, `<link rel="canonical" href="%s">`, canonical)
+			}
+			fmt.Fprint(w, "</head><body>")
+			for _, link := range links {
+				fmt.Fprintf(w, `<a href="%s">%s</a>`, link, link)
+			}
+			fmt.Fprint(w, "</body></html>")
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		page("", "/article", "/print/article")(w, r)
+	})
+	mux.HandleFunc("/article", page("/article", "/comments"))
+	// The print version is a copy of the article, so its
+	// links shouldn't be followed.
+	mux.HandleFunc("/print/article", page("/article", "/print/only"))
+	mux.HandleFunc("/comments", page(""))
+	mux.HandleFunc("/print/only", page(""))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	sink := &collectSink{}
+	crawler := New(Config{
+		Seeds: []string{srv.URL + "/"},
+		Scope: &Scope{Domains: []string{"127.0.0.1"}},
+		Sinks: []Sink{sink},
+	})
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := make([]string, len(sink.urls))
+	for i, URL := range sink.urls {
+		got[i] = URL[len(srv.URL):]
+	}
+	sort.Strings(got)
+	want := []string{"/", "/article", "/comments", "/print/article"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got results for %v, want %v", got, want)
+	}
+}
+
+func TestCrawlerAssets(t *testing.T) {
+	var assetFetches int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			atomic.AddInt32(&assetFetches, 1)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<link rel="stylesheet" href="/style.css">`)
+		fmt.Fprint(w, `<script src="/app.js"></script>`)
+		fmt.Fprint(w, `<img src="/logo.png"><a href="/a">a</a>`)
+	})
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<p>a</p>")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	sink := &collectSink{}
+	crawler := New(Config{
+		Seeds: []string{srv.URL + "/"},
+		// Assets mustn't use up the pages we may crawl.
+		Scope: &Scope{Domains: []string{"127.0.0.1"}, MaxPages: 2},
+		Sinks: []Sink{sink},
+	})
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{srv.URL + "/", srv.URL + "/a"}
+	if !reflect.DeepEqual(sink.urls, want) {
+		t.Errorf("got results for %v, want %v", sink.urls, want)
+	}
+	if n := atomic.LoadInt32(&assetFetches); n != 0 {
+		t.Errorf("got %d asset fetches, want none", n)
+	}
+}
+
+func TestCrawlerCancel(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<a href="/a">a</a><a href="/b">b</a>`)
+	})
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<a href="/c">c</a>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	sink := &collectSink{}
+	frontier := NewFrontier()
+	crawler := New(Config{
+		Seeds: []string{srv.URL + "/"},
+		Scope: &Scope{Domains: []string{"127.0.0.1"}},
+		// A single worker, so /b waits for /a.
+		Workers:  1,
+		Frontier: frontier,
+		Sinks:    []Sink{sink},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- crawler.Run(ctx)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for /a to be fetched")
+	}
+	cancel()
+	close(release)
+
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Run to return")
+	}
+
+	// The page being fetched when we canceled is still reported...
+	want := []string{srv.URL + "/", srv.URL + "/a"}
+	if !reflect.DeepEqual(sink.urls, want) {
+		t.Errorf("got results for %v, want %v", sink.urls, want)
+	}
+	// ...and the ones we didn't get to are left pending.
+	var pending []string
+	for _, job := range frontier.Pending() {
+		pending = append(pending, job.URL)
+	}
+	sort.Strings(pending)
+	want = []string{srv.URL + "/b", srv.URL + "/c"}
+	if !reflect.DeepEqual(pending, want) {
+		t.Errorf("got pending %v, want %v", pending, want)
+	}
+}
+
+func TestCrawlerCancelRetry(t *testing.T) {
+	var robotsFetches int32
+	retrying := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&robotsFetches, 1)
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case retrying <- struct{}{}:
+		default:
+		}
+		// Far longer than the test is willing to wait.
+		w.Header().Set(headerRetryAfter, "50")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	frontier := NewFrontier()
+	crawler := New(Config{
+		Seeds:    []string{srv.URL + "/"},
+		Scope:    &Scope{Domains: []string{"127.0.0.1"}},
+		Robots:   NewRobotsCache(DefaultUserAgent),
+		Fetcher:  NewFetcher(FetcherConfig{}),
+		Frontier: frontier,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- crawler.Run(ctx)
+	}()
+
+	select {
+	case <-retrying:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the seed to be fetched")
+	}
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Run to stop waiting to retry")
+	}
+
+	// We never got the page, so it's still pending.
+	pending := frontier.Pending()
+	if len(pending) != 1 || pending[0].URL != srv.URL+"/" {
+		t.Errorf("got pending %v, want the seed", pending)
+	}
+	if n := atomic.LoadInt32(&robotsFetches); n != 1 {
+		t.Errorf("got %d robots.txt fetches, want 1", n)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	q := newJobQueue(3)
+	q.Push(&Job{URL: "http://a.com/b", Depth: 1})
+	q.Push(&Job{URL: "http://a.com/c", Depth: 1})
+	q.Push(&Job{URL: "http://a.com/a", Depth: 0})
+	if q.Push(&Job{URL: "http://a.com/d", Depth: 0}) {
+		t.Errorf("pushed onto a full queue")
+	}
+
+	idle := func(host string) bool { return false }
+	var got []string
+	for job := q.Next(idle); job != nil; job = q.Next(idle) {
+		got = append(got, job.URL)
+	}
+	want := []string{"http://a.com/a", "http://a.com/b", "http://a.com/c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestJobQueueBusyHost(t *testing.T) {
+	q := newJobQueue(10)
+	for _, URL := range []string{"http://a.com/1", "http://a.com/2", "http://b.com/1", "http://a.com/3", "http://b.com/2"} {
+		q.Push(&Job{URL: URL})
+	}
+
+	busy := map[string]bool{"a.com": true}
+	isBusy := func(host string) bool { return busy[host] }
+	var got []string
+	for job := q.Next(isBusy); job != nil; job = q.Next(isBusy) {
+		got = append(got, job.URL)
+	}
+	want := []string{"http://b.com/1", "http://b.com/2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v while a.com is busy, want %v", got, want)
+	}
+	// The parked jobs still count against the queue's size.
+	if q.Len() != 3 {
+		t.Errorf("got Len %d, want 3", q.Len())
+	}
+
+	busy["a.com"] = false
+	q.Unpark("a.com")
+	got = nil
+	for job := q.Next(isBusy); job != nil; job = q.Next(isBusy) {
+		got = append(got, job.URL)
+	}
+	want = []string{"http://a.com/1", "http://a.com/2", "http://a.com/3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v once a.com is free, want %v", got, want)
+	}
+}
+
+// funcSink calls a function with every result.
+type funcSink func(result *JobResult)
+
+func (fs funcSink) Write(result *JobResult) error {
+	fs(result)
+	return nil
+}
+
+func (fs funcSink) Close() error {
+	return nil
+}
+
+func TestCrawlerSlowHost(t *testing.T) {
+	release := make(chan struct{})
+	fast := newSite(t, map[string][]string{
+		"/":   {"/f1", "/f2", "/f3"},
+		"/f1": {},
+		"/f2": {},
+		"/f3": {},
+	})
+	slowMux := http.NewServeMux()
+	slowMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// The slow pages come before the fast host in the queue.
+		w.Header().Set("Content-Type", "text/html")
+		for i := 1; i <= 5; i++ {
+			fmt.Fprintf(w, `<a href="/s%d">s</a>`, i)
+		}
+		fmt.Fprintf(w, `<a href="%s/">fast</a>`, fast.URL)
+	})
+	for i := 1; i <= 5; i++ {
+		slowMux.HandleFunc(fmt.Sprintf("/s%d", i), func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		})
+	}
+	slow := httptest.NewServer(slowMux)
+	defer slow.Close()
+	unblock := sync.OnceFunc(func() { close(release) })
+	defer unblock()
+
+	fastDone := make(chan struct{})
+	var fastPages int32
+	crawler := New(Config{
+		Seeds: []string{slow.URL + "/"},
+		Scope: &Scope{Domains: []string{"127.0.0.1"}},
+		// Fewer workers than slow pages: if the workers waited
+		// on the slow host, none would be left for the fast one.
+		Workers: 3,
+		PerHost: 1,
+		Sinks: []Sink{funcSink(func(result *JobResult) {
+			if strings.HasPrefix(result.URL, fast.URL) {
+				if atomic.AddInt32(&fastPages, 1) == 4 {
+					close(fastDone)
+				}
+			}
+		})},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- crawler.Run(ctx)
+	}()
+
+	select {
+	case <-fastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("crawled %d of the fast host's 4 pages while the slow host was stuck", atomic.LoadInt32(&fastPages))
+	}
+	cancel()
+	unblock()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
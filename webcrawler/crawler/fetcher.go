@@ -0,0 +1,307 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zicodeng/go-example/htmlcharset"
+)
+
+// Default settings used by NewFetcher when the
+// corresponding FetcherConfig field is left zero.
+const (
+	defaultTimeout         = 30 * time.Second
+	defaultMaxRetries      = 3
+	defaultMinBackoff      = time.Second
+	defaultMaxBackoff      = time.Minute
+	defaultMaxBodyBytes    = 10 << 20
+	defaultMaxConnsPerHost = 2
+)
+
+// Headers used for conditional requests.
+const (
+	headerETag            = "ETag"
+	headerLastModified    = "Last-Modified"
+	headerIfNoneMatch     = "If-None-Match"
+	headerIfModifiedSince = "If-Modified-Since"
+	headerRetryAfter      = "Retry-After"
+)
+
+// FetcherConfig holds the settings for a Fetcher.
+type FetcherConfig struct {
+	// Timeout bounds each request, including reading the body.
+	Timeout time.Duration
+	// UserAgent is sent in the User-Agent header.
+	UserAgent string
+	// MaxRetries is how many times a request that got a 429 or
+	// 5xx response is retried. Use a negative number to never retry.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponential backoff
+	// between retries. A Retry-After header longer than
+	// MaxBackoff isn't waited for: the request fails instead.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxBodyBytes is how much of a page we read. Longer
+	// pages are cut off, keeping the links found so far.
+	MaxBodyBytes int64
+	// MaxConnsPerHost limits the connections open to each host.
+	MaxConnsPerHost int
+	// Cache, if set, is used to make conditional requests
+	// for pages we've crawled before, and to get their
+	// links back when they haven't changed.
+	Cache *PageCache
+	// Metrics, if set, counts the bytes read and
+	// the latency of the requests to each host.
+	Metrics *Metrics
+}
+
+// Fetcher fetches pages and extracts their links.
+// It is safe for concurrent use.
+type Fetcher struct {
+	cfg    FetcherConfig
+	client *http.Client
+}
+
+// NewFetcher constructs a new Fetcher.
+func NewFetcher(cfg FetcherConfig) *Fetcher {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if len(cfg.UserAgent) == 0 {
+		cfg.UserAgent = DefaultUserAgent
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if cfg.MaxConnsPerHost <= 0 {
+		cfg.MaxConnsPerHost = defaultMaxConnsPerHost
+	}
+
+	// The transport asks for gzip and decompresses it for us,
+	// as long as we don't set Accept-Encoding ourselves.
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: cfg.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		MaxIdleConnsPerHost:   cfg.MaxConnsPerHost,
+	}
+	return &Fetcher{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: cfg.Timeout},
+	}
+}
+
+// GetPageLinks fetches PageLinks info for a given URL. It returns the
+// status code of the last response, or 0 if we didn't get one. If the
+// page hasn't changed since it was cached, the status is 304 and the
+// cached PageLinks are returned. Once ctx is done no more retries are
+// made, and GetPageLinks returns ctx's error instead of waiting.
+func (f *Fetcher) GetPageLinks(ctx context.Context, URL string) (*PageLinks, int, error) {
+	var cached *CachedPage
+	if f.cfg.Cache != nil {
+		cached = f.cfg.Cache.Get(URL)
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		// A request we've sent is finished even if ctx is canceled,
+		// so interrupting a crawl doesn't waste the pages being
+		// fetched. Timeout still bounds it. Waiting to retry is
+		// another matter, and stops as soon as ctx is done.
+		resp, err = f.do(context.WithoutCancel(ctx), URL, cached)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !isRetryableStatus(resp.StatusCode) || attempt >= f.cfg.MaxRetries {
+			break
+		}
+		wait, ok := f.backoff(attempt+1, resp.Header.Get(headerRetryAfter))
+		if !ok {
+			break
+		}
+		// Drain the body so the connection can be reused.
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		if err := sleep(ctx, wait); err != nil {
+			return nil, 0, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.PL, resp.StatusCode, nil
+	}
+	// If not OK, return an error.
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, &StatusError{URL, resp.StatusCode}
+	}
+
+	// If the requested URL is not an HTML page,
+	// just return an empty PageLinks structure.
+	if !strings.HasPrefix(resp.Header.Get(headerContentType), contentTypeHTML) {
+		return &PageLinks{}, resp.StatusCode, nil
+	}
+	// The tokenizer only reads UTF-8, so transcode pages
+	// in other encodings first.
+	counter := &countingReader{r: io.LimitReader(resp.Body, f.cfg.MaxBodyBytes)}
+	if f.cfg.Metrics != nil {
+		defer func() { f.cfg.Metrics.addBytes(counter.n) }()
+	}
+	body, _, err := htmlcharset.NewReader(counter, resp.Header.Get(headerContentType))
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("error reading %s: %v", URL, err)
+	}
+	// Relative links are resolved against the URL we were
+	// redirected to, if any, not the one we asked for.
+	pl, err := parsePageLinks(resp.Request.URL, body)
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("error parsing %s: %v", URL, err)
+	}
+
+	if f.cfg.Cache != nil {
+		page := &CachedPage{
+			ETag:         resp.Header.Get(headerETag),
+			LastModified: resp.Header.Get(headerLastModified),
+			PL:           pl,
+		}
+		// Without a validator we could never get a 304.
+		if len(page.ETag) > 0 || len(page.LastModified) > 0 {
+			f.cfg.Cache.Put(URL, page)
+		}
+	}
+	return pl, resp.StatusCode, nil
+}
+
+// do makes one request for URL, made conditional
+// on the validators of the cached page, if any.
+func (f *Fetcher) do(ctx context.Context, URL string, cached *CachedPage) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for %s: %v", URL, err)
+	}
+	req.Header.Set("User-Agent", f.cfg.UserAgent)
+	if cached != nil {
+		if len(cached.ETag) > 0 {
+			req.Header.Set(headerIfNoneMatch, cached.ETag)
+		}
+		if len(cached.LastModified) > 0 {
+			req.Header.Set(headerIfModifiedSince, cached.LastModified)
+		}
+	}
+	start := time.Now()
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// Wrap the error, so callers can tell timeouts apart.
+		return nil, fmt.Errorf("error getting URL %s: %w", URL, err)
+	}
+	if f.cfg.Metrics != nil {
+		f.cfg.Metrics.observeRequest(req.URL.Host, time.Since(start))
+	}
+	return resp, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// backoff returns how long to wait before the given retry attempt:
+// exponential growth from MinBackoff, capped at MaxBackoff, with
+// jitter, or what the Retry-After header asks for if it's longer.
+// It returns false if Retry-After asks for longer than MaxBackoff.
+func (f *Fetcher) backoff(attempt int, retryAfter string) (time.Duration, bool) {
+	d := f.cfg.MinBackoff << uint(attempt-1)
+	if d <= 0 || d > f.cfg.MaxBackoff {
+		d = f.cfg.MaxBackoff
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+
+	if wait, ok := parseRetryAfter(retryAfter, time.Now()); ok {
+		if wait > f.cfg.MaxBackoff {
+			return 0, false
+		}
+		if wait > d {
+			d = wait
+		}
+	}
+	return d, true
+}
+
+// isRetryableStatus reports whether a response with the
+// given status code is worth retrying: the server is
+// overloaded or had a problem that may go away.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter parses a Retry-After header, which is either
+// a number of seconds or an HTTP date, into how long to wait.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		wait := at.Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	// select picks at random among ready cases,
+	// so don't let a zero wait hide a done ctx.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
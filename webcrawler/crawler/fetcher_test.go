@@ -0,0 +1,254 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetcherStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="/a">a</a>`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name       string
+		URL        string
+		wantStatus int
+		wantLinks  int
+		wantErr    bool
+	}{
+		{"ok", srv.URL + "/ok", 200, 1, false},
+		{"not html", srv.URL + "/image", 200, 0, false},
+		{"not found", srv.URL + "/missing", 404, 0, true},
+		{"network error", "http://127.0.0.1:1/", 0, 0, true},
+	}
+
+	f := NewFetcher(FetcherConfig{MaxRetries: -1})
+	for _, c := range cases {
+		pl, status, err := f.GetPageLinks(context.Background(), c.URL)
+		if status != c.wantStatus {
+			t.Errorf("\ncase: %s\ngot status: %d\nwant: %d", c.name, status, c.wantStatus)
+		}
+		if (err != nil) != c.wantErr {
+			t.Errorf("\ncase: %s\nunexpected error: %v", c.name, err)
+		}
+		if err == nil && len(pl.Links) != c.wantLinks {
+			t.Errorf("\ncase: %s\ngot %d links, want %d", c.name, len(pl.Links), c.wantLinks)
+		}
+		var se *StatusError
+		if errors.As(err, &se) && se.Code != c.wantStatus {
+			t.Errorf("\ncase: %s\ngot StatusError code %d, want %d", c.name, se.Code, c.wantStatus)
+		}
+	}
+}
+
+func TestFetcherRetries(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if ua := r.Header.Get("User-Agent"); ua != "test-agent" {
+			t.Errorf("got User-Agent %q, want test-agent", ua)
+		}
+		switch {
+		case requests == 1:
+			w.Header().Set(headerRetryAfter, "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case requests == 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/later":
+			w.Header().Set(headerRetryAfter, "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<title>OK</title>")
+		}
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{
+		UserAgent:  "test-agent",
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	})
+	pl, status, err := f.GetPageLinks(context.Background(), srv.URL+"/")
+	if err != nil || status != 200 || pl.Title != "OK" {
+		t.Fatalf("got %+v, %d, %v after retries, want the page", pl, status, err)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+
+	// A Retry-After longer than MaxBackoff isn't waited for.
+	requests = 2
+	_, status, err = f.GetPageLinks(context.Background(), srv.URL+"/later")
+	if status != http.StatusServiceUnavailable || err == nil {
+		t.Errorf("got %d, %v, want a 503 error", status, err)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 1 more", requests-2)
+	}
+}
+
+func TestFetcherConditional(t *testing.T) {
+	const etag = `"v1"`
+	var notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerIfNoneMatch) == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set(headerETag, etag)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<title>Cached</title><a href="/a">a</a>`)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	cache, err := OpenPageCache(path)
+	if err != nil {
+		t.Fatalf("error opening cache: %v", err)
+	}
+	f := NewFetcher(FetcherConfig{Cache: cache})
+	if _, status, err := f.GetPageLinks(context.Background(), srv.URL); err != nil || status != 200 {
+		t.Fatalf("got %d, %v on the first fetch", status, err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatalf("error saving cache: %v", err)
+	}
+
+	// Crawl again with the saved cache.
+	cache, err = OpenPageCache(path)
+	if err != nil {
+		t.Fatalf("error reopening cache: %v", err)
+	}
+	f = NewFetcher(FetcherConfig{Cache: cache})
+	pl, status, err := f.GetPageLinks(context.Background(), srv.URL)
+	if err != nil || status != http.StatusNotModified {
+		t.Fatalf("got %d, %v, want 304", status, err)
+	}
+	if notModified != 1 {
+		t.Errorf("got %d conditional hits, want 1", notModified)
+	}
+	if pl.Title != "Cached" || len(pl.Links) != 1 {
+		t.Errorf("got %+v, want the cached page", pl)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		input  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Tue, 02 Jan 2018 03:05:05 GMT", time.Minute, true},
+		{"Tue, 02 Jan 2018 03:00:00 GMT", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range cases {
+		got, ok := parseRetryAfter(c.input, now)
+		if got != c.want || ok != c.wantOK {
+			t.Errorf("\ninput: %q\ngot: %v, %v\nwant: %v, %v", c.input, got, ok, c.want, c.wantOK)
+		}
+	}
+}
+
+func TestFetcherMaxBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<a href="/a">a</a>`+strings.Repeat(" ", 1000)+`<a href="/b">b</a>`)
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{MaxBodyBytes: 100})
+	pl, _, err := f.GetPageLinks(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pl.Links) != 1 {
+		t.Errorf("got %d links, want only the one before the limit", len(pl.Links))
+	}
+}
+
+func TestFetcherCharset(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=Shift_JIS")
+		// "日本" in Shift_JIS.
+		fmt.Fprint(w, "<title>\x93\xfa\x96\x7b</title>")
+	}))
+	defer srv.Close()
+
+	pl, _, err := NewFetcher(FetcherConfig{}).GetPageLinks(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pl.Title != "日本" {
+		t.Errorf("got title %q, want %q", pl.Title, "日本")
+	}
+}
+
+func TestFetcherRedirectBase(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new/dir/", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/new/dir/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<a href="page.html">page</a>`)
+	})
+	mux.HandleFunc("/based", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<head><base href="/static/"></head><a href="page.html">page</a>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cases := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			name: "redirect",
+			path: "/old",
+			want: srv.URL + "/new/dir/page.html",
+		},
+		{
+			name: "base element",
+			path: "/based",
+			want: srv.URL + "/static/page.html",
+		},
+	}
+
+	fetcher := NewFetcher(FetcherConfig{})
+	for _, c := range cases {
+		pl, _, err := fetcher.GetPageLinks(context.Background(), srv.URL+c.path)
+		if err != nil {
+			t.Fatalf("\ncase: %s\nunexpected error: %v", c.name, err)
+		}
+		if len(pl.Links) != 1 || pl.Links[0].URL != c.want {
+			t.Errorf("\ncase: %s\ngot: %v\nwant: %s", c.name, pl.Links, c.want)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package crawler
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Files in a crawl state directory.
+const (
+	checkpointFile = "checkpoint.json"
+	journalFile    = "journal.jsonl"
+)
+
+// Journal operations.
+const (
+	opAdd  = "add"
+	opSeen = "seen"
+	opDone = "done"
+)
+
+// journalEntry is one line of the journal.
+type journalEntry struct {
+	Op    string `json:"op"`
+	URL   string `json:"url"`
+	Depth int    `json:"depth,omitempty"`
+	// LastMod and Priority are only set on
+	// adds, for jobs that have them.
+	LastMod  *time.Time `json:"lastmod,omitempty"`
+	Priority float64    `json:"priority,omitempty"`
+}
+
+// checkpoint is the full crawl state at some point in time.
+type checkpoint struct {
+	StartURL string   `json:"startURL"`
+	Queued   int      `json:"queued"`
+	Seen     []string `json:"seen"`
+	Pending  []*Job   `json:"pending"`
+}
+
+// Frontier tracks which URLs have been seen and which
+// queued jobs haven't finished yet. URLs are compared in
+// their normalized form, so all the URLs of a page are
+// seen once one of them is. If it has a directory,
+// every change is appended to a journal there, and the state
+// can be checkpointed, so that a crawl can be resumed after
+// a crash with OpenFrontier. It is not safe for concurrent use.
+type Frontier struct {
+	dir     string
+	journal *os.File
+
+	startURL string
+	queued   int
+	seen     map[string]bool
+	// pending holds the jobs that aren't done, and order the
+	// ones Next hasn't returned yet, so they can be handed out
+	// without sorting them all each time.
+	pending map[string]*queuedJob
+	order   jobHeap
+	seq     int
+}
+
+// NewFrontier constructs a new in-memory Frontier.
+func NewFrontier() *Frontier {
+	return &Frontier{
+		seen:    map[string]bool{},
+		pending: map[string]*queuedJob{},
+	}
+}
+
+// OpenFrontier opens the Frontier persisted in dir, creating
+// the directory if it doesn't exist yet. It loads the last
+// checkpoint and replays the journal written after it.
+func OpenFrontier(dir string) (*Frontier, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating state directory: %v", err)
+	}
+	f := NewFrontier()
+	f.dir = dir
+
+	if err := f.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	if err := f.replayJournal(); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %v", err)
+	}
+	f.journal = journal
+	return f, nil
+}
+
+func (f *Frontier) loadCheckpoint() error {
+	file, err := os.Open(filepath.Join(f.dir, checkpointFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening checkpoint: %v", err)
+	}
+	defer file.Close()
+
+	cp := &checkpoint{}
+	if err := json.NewDecoder(file).Decode(cp); err != nil {
+		return fmt.Errorf("error decoding checkpoint: %v", err)
+	}
+	f.startURL = cp.StartURL
+	f.queued = cp.Queued
+	for _, URL := range cp.Seen {
+		f.seen[pageKey(URL)] = true
+	}
+	for _, job := range cp.Pending {
+		f.addPending(pageKey(job.URL), job)
+	}
+	return nil
+}
+
+func (f *Frontier) replayJournal() error {
+	path := filepath.Join(f.dir, journalFile)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening journal: %v", err)
+	}
+	defer file.Close()
+
+	// good is the length of the journal up to the last complete entry.
+	var good int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A line without a newline was cut short
+			// by a crash while we were writing it.
+			break
+		}
+		entry := &journalEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			break
+		}
+		f.apply(entry)
+		good += int64(len(line))
+	}
+
+	// Drop anything after the last complete entry, otherwise
+	// new entries would be appended to a broken line.
+	if err := os.Truncate(path, good); err != nil {
+		return fmt.Errorf("error repairing journal: %v", err)
+	}
+	return nil
+}
+
+// apply updates the in-memory state for a journal entry.
+func (f *Frontier) apply(entry *journalEntry) {
+	key := pageKey(entry.URL)
+	switch entry.Op {
+	case opAdd:
+		if len(f.startURL) == 0 {
+			f.startURL = entry.URL
+		}
+		// Entries can be replayed twice if we crashed while
+		// checkpointing, so only count a URL the first time.
+		if !f.seen[key] {
+			f.queued++
+		}
+		f.seen[key] = true
+		f.addPending(key, &Job{
+			URL:      entry.URL,
+			Depth:    entry.Depth,
+			LastMod:  entry.LastMod,
+			Priority: entry.Priority,
+		})
+	case opSeen:
+		f.seen[key] = true
+	case opDone:
+		f.removePending(key)
+	}
+}
+
+// addPending makes job the pending job for key.
+func (f *Frontier) addPending(key string, job *Job) {
+	f.removePending(key)
+	item := &queuedJob{job: job, seq: f.seq}
+	f.seq++
+	f.pending[key] = item
+	heap.Push(&f.order, item)
+}
+
+// removePending drops the pending job for key, if any.
+func (f *Frontier) removePending(key string) {
+	item, found := f.pending[key]
+	if !found {
+		return
+	}
+	if item.index >= 0 {
+		heap.Remove(&f.order, item.index)
+	}
+	delete(f.pending, key)
+}
+
+// record applies the entry and appends it to the journal.
+func (f *Frontier) record(entry *journalEntry) error {
+	f.apply(entry)
+	if f.journal == nil {
+		return nil
+	}
+	// One write per entry, so a crash loses at most the entry being written.
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := f.journal.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("error writing journal: %v", err)
+	}
+	return nil
+}
+
+// StartURL returns the URL of the first job ever added.
+func (f *Frontier) StartURL() string {
+	return f.startURL
+}
+
+// Queued returns the number of jobs ever added.
+func (f *Frontier) Queued() int {
+	return f.queued
+}
+
+// Seen reports whether URL was added or marked as seen.
+func (f *Frontier) Seen(URL string) bool {
+	return f.seen[pageKey(URL)]
+}
+
+// MarkSeen marks URL as seen without adding a job for it.
+func (f *Frontier) MarkSeen(URL string) error {
+	return f.record(&journalEntry{Op: opSeen, URL: URL})
+}
+
+// Add marks the job's URL as seen and the job as pending.
+func (f *Frontier) Add(job *Job) error {
+	return f.record(&journalEntry{
+		Op:       opAdd,
+		URL:      job.URL,
+		Depth:    job.Depth,
+		LastMod:  job.LastMod,
+		Priority: job.Priority,
+	})
+}
+
+// Done marks the job for URL as finished.
+func (f *Frontier) Done(URL string) error {
+	return f.record(&journalEntry{Op: opDone, URL: URL})
+}
+
+// Pending returns the jobs that were added but aren't done,
+// shallowest first, then by highest Priority.
+func (f *Frontier) Pending() []*Job {
+	jobs := make([]*Job, 0, len(f.pending))
+	for _, item := range f.pending {
+		jobs = append(jobs, item.job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Depth != jobs[j].Depth {
+			return jobs[i].Depth < jobs[j].Depth
+		}
+		if jobs[i].Priority != jobs[j].Priority {
+			return jobs[i].Priority > jobs[j].Priority
+		}
+		return jobs[i].URL < jobs[j].URL
+	})
+	return jobs
+}
+
+// NumPending returns the number of jobs that aren't done.
+func (f *Frontier) NumPending() int {
+	return len(f.pending)
+}
+
+// Next returns the next pending job Next hasn't returned yet,
+// shallowest first, then by highest Priority, then in the order
+// they were added. It returns nil if there are none left.
+func (f *Frontier) Next() *Job {
+	if len(f.order) == 0 {
+		return nil
+	}
+	return heap.Pop(&f.order).(*queuedJob).job
+}
+
+// Checkpoint writes the full state to the checkpoint file and
+// empties the journal, so resuming doesn't replay a journal
+// that grows for the whole crawl.
+func (f *Frontier) Checkpoint() error {
+	if f.journal == nil {
+		return nil
+	}
+	cp := &checkpoint{
+		StartURL: f.startURL,
+		Queued:   f.queued,
+		Seen:     make([]string, 0, len(f.seen)),
+		Pending:  f.Pending(),
+	}
+	for URL := range f.seen {
+		cp.Seen = append(cp.Seen, URL)
+	}
+	sort.Strings(cp.Seen)
+
+	// Write to a temporary file and rename it over the old
+	// checkpoint, so a crash never leaves a partial checkpoint.
+	path := filepath.Join(f.dir, checkpointFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating checkpoint: %v", err)
+	}
+	if err := json.NewEncoder(tmp).Encode(cp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing checkpoint: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing checkpoint: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error replacing checkpoint: %v", err)
+	}
+
+	// Everything in the journal is now in the checkpoint. If we crash
+	// before truncating, apply makes replaying it on top harmless.
+	if err := f.journal.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating journal: %v", err)
+	}
+	return nil
+}
+
+// Close closes the journal.
+func (f *Frontier) Close() error {
+	if f.journal == nil {
+		return nil
+	}
+	return f.journal.Close()
+}
@@ -0,0 +1,96 @@
+package crawler
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFrontierResume(t *testing.T) {
+	dir := t.TempDir()
+
+	f, err := OpenFrontier(dir)
+	if err != nil {
+		t.Fatalf("error opening frontier: %v", err)
+	}
+	f.Add(&Job{URL: "http://a.com/", Depth: 0})
+	f.Add(&Job{URL: "http://a.com/x", Depth: 1})
+	f.Done("http://a.com/")
+	// Some state goes into the checkpoint...
+	if err := f.Checkpoint(); err != nil {
+		t.Fatalf("error checkpointing: %v", err)
+	}
+	// ...and the rest only into the journal.
+	f.Add(&Job{URL: "http://a.com/y/", Depth: 1})
+	f.MarkSeen("http://a.com/canonical")
+	f.Done("http://a.com/x")
+	f.Close()
+
+	// Simulate a crash in the middle of writing a journal entry.
+	journal, _ := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	journal.WriteString(`{"op":"add","url":"http://a.com/z`)
+	journal.Close()
+
+	f, err = OpenFrontier(dir)
+	if err != nil {
+		t.Fatalf("error reopening frontier: %v", err)
+	}
+
+	if f.StartURL() != "http://a.com/" {
+		t.Errorf("incorrect start URL: expected %s but got %s", "http://a.com/", f.StartURL())
+	}
+	if f.Queued() != 3 {
+		t.Errorf("incorrect queued count: expected %d but got %d", 3, f.Queued())
+	}
+	// Jobs keep the URL they were added with...
+	expectedPending := []*Job{{URL: "http://a.com/y/", Depth: 1}}
+	if pending := f.Pending(); !reflect.DeepEqual(pending, expectedPending) {
+		t.Errorf("incorrect pending jobs: expected %v but got %v", expectedPending, pending)
+	}
+	// ...but are seen under any form of it.
+	for _, URL := range []string{"http://a.com/", "http://a.com/x", "http://A.com/y", "http://a.com/canonical"} {
+		if !f.Seen(URL) {
+			t.Errorf("expected %s to be seen", URL)
+		}
+	}
+	if f.Seen("http://a.com/z") {
+		t.Errorf("expected the partial journal entry to be ignored")
+	}
+
+	// New entries must still be readable after the repair.
+	f.Add(&Job{URL: "http://a.com/w", Depth: 2})
+	f.Close()
+	f, err = OpenFrontier(dir)
+	if err != nil {
+		t.Fatalf("error reopening frontier: %v", err)
+	}
+	defer f.Close()
+	if !f.Seen("http://a.com/w") {
+		t.Errorf("expected %s to be seen after repairing the journal", "http://a.com/w")
+	}
+}
+
+func TestFrontierNext(t *testing.T) {
+	f := NewFrontier()
+	f.Add(&Job{URL: "http://a.com/", Depth: 0})
+	f.Add(&Job{URL: "http://a.com/x", Depth: 2})
+	f.Add(&Job{URL: "http://a.com/y", Depth: 1})
+	f.Add(&Job{URL: "http://a.com/z", Depth: 1, Priority: 0.8})
+	f.Add(&Job{URL: "http://a.com/w", Depth: 1})
+	f.Done("http://a.com/")
+	f.Done("http://a.com/w")
+
+	var got []string
+	for job := f.Next(); job != nil; job = f.Next() {
+		got = append(got, job.URL)
+	}
+	expected := []string{"http://a.com/z", "http://a.com/y", "http://a.com/x"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("incorrect order: expected %v but got %v", expected, got)
+	}
+	// The jobs handed out stay pending until they are done.
+	if f.NumPending() != 3 {
+		t.Errorf("incorrect pending count: expected %d but got %d", 3, f.NumPending())
+	}
+}
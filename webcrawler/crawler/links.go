@@ -0,0 +1,235 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+const headerContentType = "Content-Type"
+const contentTypeHTML = "text/html"
+
+// PageLinks contains summary information about a web page.
+type PageLinks struct {
+	Title string  `json:"title"`
+	Links []*Link `json:"links"`
+	// Canonical is the absolute URL from the page's
+	// <link rel="canonical">, if it has one.
+	Canonical string `json:"canonical,omitempty"`
+}
+
+// Link is an absolute URL found in a page.
+type Link struct {
+	URL string `json:"url"`
+	// Tag and Attr are the element and attribute
+	// the URL came from, such as "img" and "srcset".
+	Tag  string `json:"tag"`
+	Attr string `json:"attr"`
+	// Rel is the element's rel attribute, if it has one.
+	Rel string `json:"rel,omitempty"`
+	// NoFollow is set if Rel includes "nofollow",
+	// which asks crawlers not to follow the link.
+	NoFollow bool `json:"nofollow,omitempty"`
+}
+
+// linkAttrs lists the attributes that hold
+// URLs, for each element we get links from.
+var linkAttrs = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"link":   {"href"},
+	"img":    {"src", "srcset"},
+	"source": {"src", "srcset"},
+	"script": {"src"},
+	"iframe": {"src"},
+}
+
+// pageTags lists the elements that link to other pages,
+// as opposed to the images, scripts and styles a page loads.
+var pageTags = map[string]bool{
+	"a":      true,
+	"area":   true,
+	"iframe": true,
+}
+
+// isPage reports whether l links to another page.
+func (l *Link) isPage() bool {
+	return pageTags[l.Tag]
+}
+
+// StatusError is returned by GetPageLinks when
+// the response status code is not 200 OK.
+type StatusError struct {
+	URL  string
+	Code int
+}
+
+func (se *StatusError) Error() string {
+	return fmt.Sprintf("error response status code %d while fetching %s", se.Code, se.URL)
+}
+
+// parsePageLinks reads the PageLinks from the HTML in r,
+// resolving relative links against baseURL.
+func parsePageLinks(baseURL *url.URL, r io.Reader) (*PageLinks, error) {
+	links := &PageLinks{}
+	haveBase := false
+	tokenizer := html.NewTokenizer(r)
+	for {
+		ttype := tokenizer.Next()
+		if ttype == html.ErrorToken {
+			err := tokenizer.Err()
+			// If we reached the end of the stream
+			// return the PageLinks.
+			if err == io.EOF {
+				return links, nil
+			}
+			return links, err
+		}
+
+		// We only care about start tags.
+		if ttype != html.StartTagToken && ttype != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+
+		switch token.Data {
+		case "title":
+			// Only use the first title: an <svg> can have its own.
+			if len(links.Title) == 0 {
+				links.Title = readTitle(tokenizer)
+			}
+			continue
+		case "base":
+			// The first <base href> changes the URL that relative
+			// links are resolved against, from there on.
+			if href, ok := attrValue(token, "href"); ok && !haveBase {
+				if base, err := baseURL.Parse(strings.TrimSpace(href)); err == nil {
+					baseURL = base
+					haveBase = true
+				}
+			}
+			continue
+		}
+
+		attrs, found := linkAttrs[token.Data]
+		if !found {
+			continue
+		}
+		rel, _ := attrValue(token, "rel")
+		noFollow := hasRel(rel, "nofollow")
+
+		for _, attr := range attrs {
+			val, ok := attrValue(token, attr)
+			if !ok {
+				continue
+			}
+			// srcset holds a list of URLs, the rest only one.
+			refs := []string{val}
+			if attr == "srcset" {
+				refs = parseSrcset(val)
+			}
+			for _, ref := range refs {
+				ref = strings.TrimSpace(ref)
+				// Ignore empty and bookmark links.
+				if len(ref) == 0 || strings.HasPrefix(ref, "#") {
+					continue
+				}
+				// Parse the link against the base URL, and
+				// if there's an error (bad URL) just ignore it.
+				link, err := baseURL.Parse(ref)
+				if err != nil {
+					continue
+				}
+				links.Links = append(links.Links, &Link{
+					URL:      link.String(),
+					Tag:      token.Data,
+					Attr:     attr,
+					Rel:      rel,
+					NoFollow: noFollow,
+				})
+			}
+		}
+
+		// If this is the canonical URL of the page...
+		if token.Data == "link" && len(links.Canonical) == 0 && hasRel(rel, "canonical") {
+			if href, ok := attrValue(token, "href"); ok {
+				if link, err := baseURL.Parse(strings.TrimSpace(href)); err == nil {
+					links.Canonical = link.String()
+				}
+			}
+		}
+	} // for each token
+}
+
+// readTitle reads the text of a <title> element, up to its end tag.
+// The text can be split across several tokens, or there may be none.
+func readTitle(tokenizer *html.Tokenizer) string {
+	var title strings.Builder
+	for {
+		switch tokenizer.Next() {
+		case html.TextToken:
+			title.Write(tokenizer.Text())
+		case html.ErrorToken, html.EndTagToken:
+			return strings.TrimSpace(title.String())
+		}
+	}
+}
+
+// attrValue returns the value of the named attribute of token,
+// and whether it has it.
+func attrValue(token html.Token, key string) (string, bool) {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+// hasRel reports whether the space-separated
+// rel attribute value includes the given type.
+func hasRel(rel, typ string) bool {
+	for _, r := range strings.Fields(rel) {
+		if strings.EqualFold(r, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSrcset returns the URLs in a srcset attribute,
+// a comma-separated list of URLs each optionally
+// followed by a descriptor, like "a.png 1x, b.png 2x".
+func parseSrcset(srcset string) []string {
+	var refs []string
+	for len(srcset) > 0 {
+		// Skip the whitespace and commas before the URL.
+		srcset = strings.TrimLeft(srcset, " \t\n\r\f,")
+		if len(srcset) == 0 {
+			break
+		}
+		// The URL runs up to the next whitespace. It can contain
+		// commas, but not end in one: that separates the next URL.
+		end := strings.IndexAny(srcset, " \t\n\r\f")
+		if end < 0 {
+			end = len(srcset)
+		}
+		ref := srcset[:end]
+		srcset = srcset[end:]
+		if trimmed := strings.TrimRight(ref, ","); len(trimmed) < len(ref) {
+			refs = append(refs, trimmed)
+			continue
+		}
+		refs = append(refs, ref)
+		// Skip the descriptor.
+		if next := strings.IndexByte(srcset, ','); next >= 0 {
+			srcset = srcset[next+1:]
+		} else {
+			srcset = ""
+		}
+	}
+	return refs
+}
@@ -0,0 +1,107 @@
+package crawler
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePageLinks(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  *PageLinks
+	}{
+		{
+			name:  "title",
+			input: `<html><head><title> Hello, <b>World</b> </title></head></html>`,
+			want:  &PageLinks{Title: "Hello, <b>World</b>"},
+		},
+		{
+			name:  "empty title",
+			input: `<title></title><a href="/a">a</a>`,
+			want: &PageLinks{Links: []*Link{
+				{URL: "http://a.com/a", Tag: "a", Attr: "href"},
+			}},
+		},
+		{
+			name: "all link elements",
+			input: `<link rel="stylesheet" href="/style.css">
+				<script src="app.js"></script>
+				<a href="#top">top</a>
+				<a href="/about">about</a>
+				<img src="/logo.png" srcset="/logo-2x.png 2x, /logo,3x.png 3x">
+				<iframe src="https://b.com/embed"></iframe>
+				<map><area href="/map/1"></map>`,
+			want: &PageLinks{Links: []*Link{
+				{URL: "http://a.com/style.css", Tag: "link", Attr: "href", Rel: "stylesheet"},
+				{URL: "http://a.com/dir/app.js", Tag: "script", Attr: "src"},
+				{URL: "http://a.com/about", Tag: "a", Attr: "href"},
+				{URL: "http://a.com/logo.png", Tag: "img", Attr: "src"},
+				{URL: "http://a.com/logo-2x.png", Tag: "img", Attr: "srcset"},
+				{URL: "http://a.com/logo,3x.png", Tag: "img", Attr: "srcset"},
+				{URL: "https://b.com/embed", Tag: "iframe", Attr: "src"},
+				{URL: "http://a.com/map/1", Tag: "area", Attr: "href"},
+			}},
+		},
+		{
+			name: "base href",
+			input: `<head><base href="http://cdn.a.com/assets/"><base href="/ignored/"></head>
+				<img src="img.png"><a href="/abs">abs</a>`,
+			want: &PageLinks{Links: []*Link{
+				{URL: "http://cdn.a.com/assets/img.png", Tag: "img", Attr: "src"},
+				{URL: "http://cdn.a.com/abs", Tag: "a", Attr: "href"},
+			}},
+		},
+		{
+			name:  "nofollow",
+			input: `<a href="/ad" rel="sponsored NoFollow">ad</a>`,
+			want: &PageLinks{Links: []*Link{
+				{URL: "http://a.com/ad", Tag: "a", Attr: "href", Rel: "sponsored NoFollow", NoFollow: true},
+			}},
+		},
+		{
+			name:  "canonical",
+			input: `<link rel="canonical" href="/page">`,
+			want: &PageLinks{
+				Canonical: "http://a.com/page",
+				Links: []*Link{
+					{URL: "http://a.com/page", Tag: "link", Attr: "href", Rel: "canonical"},
+				},
+			},
+		},
+	}
+
+	base, _ := url.Parse("http://a.com/dir/page.html")
+	for _, c := range cases {
+		got, err := parsePageLinks(base, strings.NewReader(c.input))
+		if err != nil {
+			t.Errorf("\ncase: %s\nunexpected error: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("\ncase: %s\ninput: %s\ngot: %+v\nwant: %+v", c.name, c.input, got, c.want)
+		}
+	}
+}
+
+func TestParseSrcset(t *testing.T) {
+	cases := []struct {
+		input string
+		want  []string
+	}{
+		{"a.png", []string{"a.png"}},
+		{"a.png 1x, b.png 2x", []string{"a.png", "b.png"}},
+		{"a.png,b.png", []string{"a.png,b.png"}},
+		{"a.png, b.png", []string{"a.png", "b.png"}},
+		{" a.png 100w,\n b.png 200w ", []string{"a.png", "b.png"}},
+		{"", nil},
+	}
+	for _, c := range cases {
+		got := parseSrcset(c.input)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("\ninput: %q\ngot: %q\nwant: %q", c.input, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds,
+// of the request latency histogram buckets.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// defaultLatencyHosts is how many hosts get a latency histogram
+// of their own. The requests to the hosts we see after that are
+// counted under otherHost, so a crawl that wanders across the
+// web doesn't make a new series for every host it visits.
+const defaultLatencyHosts = 20
+
+// otherHost is the host label of the requests
+// to hosts without a histogram of their own.
+const otherHost = "other"
+
+// Error classes used to label the errors_total metric.
+const (
+	errClassRobots  = "robots"
+	errClass4xx     = "http_4xx"
+	errClass5xx     = "http_5xx"
+	errClassHTTP    = "http_other"
+	errClassTimeout = "timeout"
+	errClassNetwork = "network"
+	errClassOther   = "other"
+)
+
+// histogram is a Prometheus-style histogram:
+// counts[i] is the number of observations that
+// fell at or below latencyBuckets[i].
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Metrics counts what a crawl has done so far. It is
+// updated by the Crawler and its Fetcher, and served in
+// the Prometheus text format and as a JSON status page
+// by Handler. It is safe for concurrent use.
+type Metrics struct {
+	mx        sync.Mutex
+	startedAt time.Time
+	pages     map[int]int64
+	errors    map[string]int64
+	bytes     int64
+	queued    int
+	inFlight  int
+	latency   map[string]*histogram
+	// latencyHosts is the most hosts in latency,
+	// not counting otherHost.
+	latencyHosts int
+	lastURL      string
+}
+
+// NewMetrics constructs a new Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		startedAt: time.Now(),
+		pages:     map[int]int64{},
+		errors:    map[string]int64{},
+		latency:   map[string]*histogram{},
+
+		latencyHosts: defaultLatencyHosts,
+	}
+}
+
+// observeResult counts a crawled page, and its error if any.
+func (m *Metrics) observeResult(result *JobResult) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.lastURL = result.URL
+	if result.Status > 0 {
+		m.pages[result.Status]++
+	}
+	if result.Error != nil {
+		m.errors[errorClass(result.Error)]++
+	}
+}
+
+// observeRequest records the latency of a request to host.
+// The first hosts we see keep their label for the whole crawl,
+// so each series only ever counts the requests to one host.
+func (m *Metrics) observeRequest(host string, d time.Duration) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	h, found := m.latency[host]
+	if !found {
+		hosts := len(m.latency)
+		if _, found := m.latency[otherHost]; found {
+			hosts--
+		}
+		if hosts >= m.latencyHosts {
+			host = otherHost
+			h = m.latency[host]
+		}
+		if h == nil {
+			h = &histogram{}
+			m.latency[host] = h
+		}
+	}
+	h.observe(d.Seconds())
+}
+
+// addBytes counts bytes of page content read.
+func (m *Metrics) addBytes(n int64) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.bytes += n
+}
+
+// setQueue sets the number of pending and in-flight jobs.
+func (m *Metrics) setQueue(queued, inFlight int) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.queued = queued
+	m.inFlight = inFlight
+}
+
+// errorClass sorts a JobResult error into a
+// small set of classes we can label metrics with.
+func errorClass(err error) string {
+	var se *StatusError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrRobotsDisallowed):
+		return errClassRobots
+	case errors.As(err, &se):
+		switch {
+		case se.Code >= 500:
+			return errClass5xx
+		case se.Code >= 400:
+			return errClass4xx
+		}
+		return errClassHTTP
+	case errors.Is(err, context.DeadlineExceeded):
+		return errClassTimeout
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return errClassTimeout
+		}
+		return errClassNetwork
+	}
+	return errClassOther
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	ew := &errWriter{w: w}
+	ew.printf("# HELP crawler_pages_fetched_total Pages fetched, by HTTP status code.\n")
+	ew.printf("# TYPE crawler_pages_fetched_total counter\n")
+	codes := make([]int, 0, len(m.pages))
+	for code := range m.pages {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		ew.printf("crawler_pages_fetched_total{code=\"%d\"} %d\n", code, m.pages[code])
+	}
+
+	ew.printf("# HELP crawler_errors_total Pages that failed, by class of error.\n")
+	ew.printf("# TYPE crawler_errors_total counter\n")
+	for _, class := range sortedKeys(m.errors) {
+		ew.printf("crawler_errors_total{class=%q} %d\n", class, m.errors[class])
+	}
+
+	ew.printf("# HELP crawler_bytes_total Bytes of page content read.\n")
+	ew.printf("# TYPE crawler_bytes_total counter\n")
+	ew.printf("crawler_bytes_total %d\n", m.bytes)
+
+	ew.printf("# HELP crawler_queue_depth Pages waiting to be fetched.\n")
+	ew.printf("# TYPE crawler_queue_depth gauge\n")
+	ew.printf("crawler_queue_depth %d\n", m.queued)
+
+	ew.printf("# HELP crawler_in_flight Pages being fetched.\n")
+	ew.printf("# TYPE crawler_in_flight gauge\n")
+	ew.printf("crawler_in_flight %d\n", m.inFlight)
+
+	ew.printf("# HELP crawler_request_duration_seconds Time to get response headers, by host, for the first %d hosts.\n", m.latencyHosts)
+	ew.printf("# TYPE crawler_request_duration_seconds histogram\n")
+	hosts := make([]string, 0, len(m.latency))
+	for host := range m.latency {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		h := m.latency[host]
+		for i, bound := range latencyBuckets {
+			ew.printf("crawler_request_duration_seconds_bucket{host=%q,le=%q} %d\n",
+				host, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		ew.printf("crawler_request_duration_seconds_bucket{host=%q,le=\"+Inf\"} %d\n", host, h.count)
+		ew.printf("crawler_request_duration_seconds_sum{host=%q} %g\n", host, h.sum)
+		ew.printf("crawler_request_duration_seconds_count{host=%q} %d\n", host, h.count)
+	}
+	return ew.err
+}
+
+// Status is a snapshot of the progress of a crawl.
+type Status struct {
+	StartedAt      time.Time        `json:"startedAt"`
+	ElapsedSeconds float64          `json:"elapsedSeconds"`
+	PagesFetched   int64            `json:"pagesFetched"`
+	PagesPerSecond float64          `json:"pagesPerSecond"`
+	Errors         map[string]int64 `json:"errors"`
+	Bytes          int64            `json:"bytes"`
+	QueueDepth     int              `json:"queueDepth"`
+	InFlight       int              `json:"inFlight"`
+	LastURL        string           `json:"lastURL,omitempty"`
+}
+
+// Status returns a snapshot of the progress of the crawl.
+func (m *Metrics) Status() *Status {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	st := &Status{
+		StartedAt:      m.startedAt,
+		ElapsedSeconds: time.Since(m.startedAt).Seconds(),
+		Errors:         map[string]int64{},
+		Bytes:          m.bytes,
+		QueueDepth:     m.queued,
+		InFlight:       m.inFlight,
+		LastURL:        m.lastURL,
+	}
+	for _, n := range m.pages {
+		st.PagesFetched += n
+	}
+	for class, n := range m.errors {
+		st.Errors[class] = n
+	}
+	if st.ElapsedSeconds > 0 {
+		st.PagesPerSecond = float64(st.PagesFetched) / st.ElapsedSeconds
+	}
+	return st
+}
+
+// Handler returns an http.Handler serving the metrics
+// at /metrics and the status of the crawl at /status.
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WritePrometheus(w)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.Status())
+	})
+	return mux
+}
+
+// errWriter remembers the first write error,
+// so we don't have to check every Fprintf.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,124 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorClass(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{ErrRobotsDisallowed, errClassRobots},
+		{&StatusError{"http://a.com", 404}, errClass4xx},
+		{&StatusError{"http://a.com", 503}, errClass5xx},
+		{&StatusError{"http://a.com", 304}, errClassHTTP},
+		{fmt.Errorf("error getting URL: %w", context.DeadlineExceeded), errClassTimeout},
+		{errors.New("error parsing page"), errClassOther},
+	}
+	for _, c := range cases {
+		if got := errorClass(c.err); got != c.want {
+			t.Errorf("\ninput: %v\ngot: %s\nwant: %s", c.err, got, c.want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := newSite(t, map[string][]string{
+		"/":  {"/a", "/missing"},
+		"/a": {},
+	})
+
+	metrics := NewMetrics()
+	crawler := New(Config{
+		Seeds:   []string{srv.URL + "/"},
+		Scope:   &Scope{Domains: []string{"127.0.0.1"}},
+		Metrics: metrics,
+	})
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	st := metrics.Status()
+	if st.PagesFetched != 3 || st.Errors[errClass4xx] != 1 || st.Bytes == 0 || st.QueueDepth != 0 {
+		t.Errorf("got status %+v, want 3 pages with one 4xx error", st)
+	}
+
+	// The handler serves both formats.
+	metricsSrv := httptest.NewServer(metrics.Handler())
+	defer metricsSrv.Close()
+
+	resp, err := http.Get(metricsSrv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("error getting metrics: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	buf.ReadFrom(resp.Body)
+	resp.Body.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for _, expected := range []string{
+		`crawler_pages_fetched_total{code="200"} 2`,
+		`crawler_pages_fetched_total{code="404"} 1`,
+		`crawler_errors_total{class="http_4xx"} 1`,
+		`crawler_queue_depth 0`,
+		fmt.Sprintf(`crawler_request_duration_seconds_bucket{host=%q,le="+Inf"} 3`, host),
+		fmt.Sprintf(`crawler_request_duration_seconds_count{host=%q} 3`, host),
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("metrics are missing %s:\n%s", expected, buf)
+		}
+	}
+
+	resp, err = http.Get(metricsSrv.URL + "/status")
+	if err != nil {
+		t.Fatalf("error getting status: %v", err)
+	}
+	defer resp.Body.Close()
+	got := &Status{}
+	if err := json.NewDecoder(resp.Body).Decode(got); err != nil {
+		t.Fatalf("error decoding status: %v", err)
+	}
+	if got.PagesFetched != 3 {
+		t.Errorf("got %d pages in /status, want 3", got.PagesFetched)
+	}
+}
+
+func TestMetricsLatencyHosts(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.latencyHosts = 2
+	for _, host := range []string{"a.com", "b.com", "c.com", "a.com", "d.com"} {
+		metrics.observeRequest(host, 10*time.Millisecond)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := metrics.WritePrometheus(buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range []struct {
+		host string
+		want int
+	}{
+		{"a.com", 2},
+		{"b.com", 1},
+		{otherHost, 2},
+	} {
+		expected := fmt.Sprintf(`crawler_request_duration_seconds_count{host=%q} %d`, c.host, c.want)
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("metrics are missing %s:\n%s", expected, buf)
+		}
+	}
+	for _, host := range []string{"c.com", "d.com"} {
+		if strings.Contains(buf.String(), host) {
+			t.Errorf("got a series for %s, want it counted under %s:\n%s", host, otherHost, buf)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package crawler
+
+import (
+	"net/url"
+	"strings"
+)
+
+// trackingParams are query parameters that only track where a
+// visitor came from and never change the page that is served.
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"msclkid": true,
+	"yclid":   true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"_ga":     true,
+	"_hsenc":  true,
+	"_hsmi":   true,
+}
+
+// defaultPorts are the ports that can be dropped for each scheme.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// NormalizeURL returns the canonical form of an absolute URL,
+// so that URLs for the same page compare equal:
+//   - the scheme and host are lowercased
+//   - default ports are removed
+//   - the fragment is removed
+//   - an empty path becomes "/" and other paths lose their trailing slash
+//   - tracking parameters are removed and the rest are sorted by key
+//
+// The URL passed in is not modified.
+func NormalizeURL(u *url.URL) *url.URL {
+	n := *u
+	n.Scheme = strings.ToLower(n.Scheme)
+	n.Fragment = ""
+	n.RawFragment = ""
+
+	host := strings.ToLower(n.Hostname())
+	port := n.Port()
+	if port == defaultPorts[n.Scheme] {
+		port = ""
+	}
+	// Hostname() strips the brackets around IPv6 addresses.
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if len(port) > 0 {
+		host += ":" + port
+	}
+	n.Host = host
+
+	if len(n.Path) == 0 {
+		n.Path = "/"
+		n.RawPath = ""
+	} else if len(n.Path) > 1 && strings.HasSuffix(n.Path, "/") {
+		n.Path = strings.TrimRight(n.Path, "/")
+		if len(n.Path) == 0 {
+			n.Path = "/"
+		}
+		n.RawPath = strings.TrimRight(n.RawPath, "/")
+	}
+
+	n.RawQuery = normalizeQuery(n.RawQuery)
+	n.ForceQuery = false
+	return &n
+}
+
+// normalizeQuery drops tracking parameters and sorts the rest.
+func normalizeQuery(rawQuery string) string {
+	if len(rawQuery) == 0 {
+		return ""
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Leave queries we can't parse alone rather than
+		// risk turning two different pages into one.
+		return rawQuery
+	}
+	for key := range query {
+		if trackingParams[strings.ToLower(key)] || strings.HasPrefix(strings.ToLower(key), "utm_") {
+			delete(query, key)
+		}
+	}
+	// Encode sorts by key, and keeps the order of repeated
+	// keys' values, which can be significant.
+	return query.Encode()
+}
+
+// NormalizeURLString parses and normalizes rawURL.
+func NormalizeURLString(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return NormalizeURL(u).String(), nil
+}
+
+// pageKey returns the key that identifies the page at URL
+// when deduping: its normalized form, or URL itself if it
+// can't be parsed. Only the key is normalized: we fetch the
+// URL as it was linked, since servers can treat the forms
+// differently, like /docs/ and /docs.
+func pageKey(URL string) string {
+	key, err := NormalizeURLString(URL)
+	if err != nil {
+		return URL
+	}
+	return key
+}
@@ -0,0 +1,39 @@
+package crawler
+
+import "testing"
+
+func TestNormalizeURLString(t *testing.T) {
+	cases := []struct {
+		name           string
+		input          string
+		expectedOutput string
+	}{
+		{"already normalized", "http://a.com/x", "http://a.com/x"},
+		{"uppercase scheme and host", "HTTP://A.com/x", "http://a.com/x"},
+		{"path case is kept", "http://a.com/X", "http://a.com/X"},
+		{"trailing slash", "http://a.com/x/", "http://a.com/x"},
+		{"empty path", "http://a.com", "http://a.com/"},
+		{"root path", "http://a.com/", "http://a.com/"},
+		{"fragment", "http://a.com/x#frag", "http://a.com/x"},
+		{"default http port", "http://a.com:80/x", "http://a.com/x"},
+		{"default https port", "https://a.com:443/x", "https://a.com/x"},
+		{"non-default port", "http://a.com:8080/x", "http://a.com:8080/x"},
+		{"IPv6 host", "http://[::1]:80/x", "http://[::1]/x"},
+		{"sorted query", "http://a.com/x?b=2&a=1", "http://a.com/x?a=1&b=2"},
+		{"repeated keys keep their order", "http://a.com/x?a=2&a=1", "http://a.com/x?a=2&a=1"},
+		{"tracking params", "http://a.com/x?utm_source=mail&UTM_Medium=x&gclid=1&id=3", "http://a.com/x?id=3"},
+		{"only tracking params", "http://a.com/x?utm_source=mail", "http://a.com/x"},
+		{"empty query", "http://a.com/x?", "http://a.com/x"},
+	}
+
+	for _, c := range cases {
+		output, err := NormalizeURLString(c.input)
+		if err != nil {
+			t.Errorf("\ncase: %s\ninput: %s\nunexpected error: %v", c.name, c.input, err)
+			continue
+		}
+		if output != c.expectedOutput {
+			t.Errorf("\ncase: %s\ninput: %s\ngot: %s\nwant: %s", c.name, c.input, output, c.expectedOutput)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package crawler
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sink receives every JobResult as the crawl goes.
+type Sink interface {
+	Write(result *JobResult) error
+	Close() error
+}
+
+// resultRecord is the JSON form of a JobResult.
+type resultRecord struct {
+	URL        string    `json:"url"`
+	Title      string    `json:"title,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Links      []*Link   `json:"links,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Depth      int       `json:"depth"`
+	FetchedAt  time.Time `json:"fetchedAt"`
+	DurationMS int64     `json:"durationMs"`
+}
+
+func newResultRecord(result *JobResult) *resultRecord {
+	rec := &resultRecord{
+		URL:        result.URL,
+		Status:     result.Status,
+		Depth:      result.Depth,
+		FetchedAt:  result.FetchedAt,
+		DurationMS: int64(result.Duration / time.Millisecond),
+	}
+	if result.PL != nil {
+		rec.Title = result.PL.Title
+		rec.Links = result.PL.Links
+	}
+	if result.Error != nil {
+		rec.Error = result.Error.Error()
+	}
+	return rec
+}
+
+// JSONLinesSink writes each JobResult as one line of JSON.
+type JSONLinesSink struct {
+	w   io.WriteCloser
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+// NewJSONLinesSink constructs a new JSONLinesSink writing
+// to the named file, or to standard output if name is "-".
+func NewJSONLinesSink(name string) (*JSONLinesSink, error) {
+	var w io.WriteCloser = os.Stdout
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s: %v", name, err)
+		}
+		w = f
+	}
+	buf := bufio.NewWriter(w)
+	return &JSONLinesSink{w, buf, json.NewEncoder(buf)}, nil
+}
+
+// Write implements Sink.
+func (js *JSONLinesSink) Write(result *JobResult) error {
+	if err := js.enc.Encode(newResultRecord(result)); err != nil {
+		return err
+	}
+	// Flush each line, so the output can be tailed during a crawl.
+	return js.buf.Flush()
+}
+
+// Close implements Sink.
+func (js *JSONLinesSink) Close() error {
+	if err := js.buf.Flush(); err != nil {
+		return err
+	}
+	if js.w == os.Stdout {
+		return nil
+	}
+	return js.w.Close()
+}
+
+// graphNode is a page in the LinkGraph. Pages that were
+// linked to but not crawled have Crawled set to false.
+type graphNode struct {
+	URL     string
+	Title   string
+	Status  int
+	Error   string
+	Crawled bool
+}
+
+// LinkGraph is a Sink that collects the pages and the links
+// between them, to be exported when the crawl is done.
+type LinkGraph struct {
+	nodes map[string]*graphNode
+	// links maps each crawled page to the pages it links to.
+	links map[string][]string
+}
+
+// NewLinkGraph constructs a new LinkGraph.
+func NewLinkGraph() *LinkGraph {
+	return &LinkGraph{
+		nodes: map[string]*graphNode{},
+		links: map[string][]string{},
+	}
+}
+
+func (lg *LinkGraph) node(URL string) *graphNode {
+	n, found := lg.nodes[URL]
+	if !found {
+		n = &graphNode{URL: URL}
+		lg.nodes[URL] = n
+	}
+	return n
+}
+
+// Write implements Sink.
+func (lg *LinkGraph) Write(result *JobResult) error {
+	from := pageKey(result.URL)
+	n := lg.node(from)
+	n.Crawled = true
+	n.Status = result.Status
+	if result.Error != nil {
+		n.Error = result.Error.Error()
+	}
+	if result.PL == nil {
+		return nil
+	}
+	n.Title = result.PL.Title
+
+	// Links are recorded in their normalized form,
+	// so they point at the nodes for crawled pages.
+	linked := map[string]bool{}
+	for _, link := range result.PL.Links {
+		target, err := NormalizeURLString(link.URL)
+		if err != nil || linked[target] {
+			continue
+		}
+		linked[target] = true
+		lg.node(target)
+		lg.links[from] = append(lg.links[from], target)
+	}
+	return nil
+}
+
+// Close implements Sink.
+func (lg *LinkGraph) Close() error {
+	return nil
+}
+
+// sortedURLs returns the URLs of all the nodes in order,
+// so the exports are the same for the same crawl.
+func (lg *LinkGraph) sortedURLs() []string {
+	URLs := make([]string, 0, len(lg.nodes))
+	for URL := range lg.nodes {
+		URLs = append(URLs, URL)
+	}
+	sort.Strings(URLs)
+	return URLs
+}
+
+// WriteDOT writes the graph in Graphviz DOT format.
+func (lg *LinkGraph) WriteDOT(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	fmt.Fprintln(buf, "digraph crawl {")
+	for _, URL := range lg.sortedURLs() {
+		n := lg.nodes[URL]
+		attrs := []string{"label=" + strconv.Quote(n.URL)}
+		if len(n.Title) > 0 {
+			attrs = append(attrs, "tooltip="+strconv.Quote(n.Title))
+		}
+		if !n.Crawled {
+			attrs = append(attrs, "style=dashed")
+		} else if isBroken(n) {
+			attrs = append(attrs, "color=red")
+		}
+		fmt.Fprintf(buf, "\t%s [%s];\n", strconv.Quote(n.URL), strings.Join(attrs, ", "))
+	}
+	for _, from := range lg.sortedURLs() {
+		for _, to := range lg.links[from] {
+			fmt.Fprintf(buf, "\t%s -> %s;\n", strconv.Quote(from), strconv.Quote(to))
+		}
+	}
+	fmt.Fprintln(buf, "}")
+	return buf.Flush()
+}
+
+// GraphML elements, see http://graphml.graphdrawing.org/.
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// WriteGraphML writes the graph in GraphML format.
+func (lg *LinkGraph) WriteGraphML(w io.Writer) error {
+	doc := &graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{"title", "node", "title", "string"},
+			{"status", "node", "status", "int"},
+			{"error", "node", "error", "string"},
+			{"crawled", "node", "crawled", "boolean"},
+		},
+		Graph: graphMLGraph{ID: "crawl", EdgeDefault: "directed"},
+	}
+	for _, URL := range lg.sortedURLs() {
+		n := lg.nodes[URL]
+		node := graphMLNode{ID: n.URL, Data: []graphMLData{
+			{"crawled", strconv.FormatBool(n.Crawled)},
+		}}
+		if len(n.Title) > 0 {
+			node.Data = append(node.Data, graphMLData{"title", n.Title})
+		}
+		if n.Status > 0 {
+			node.Data = append(node.Data, graphMLData{"status", strconv.Itoa(n.Status)})
+		}
+		if len(n.Error) > 0 {
+			node.Data = append(node.Data, graphMLData{"error", n.Error})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, node)
+		for _, to := range lg.links[URL] {
+			doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{URL, to})
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteGraphFile writes the graph to the named file,
+// as DOT if the name ends in .dot or .gv, or else as GraphML.
+func (lg *LinkGraph) WriteGraphFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", name, err)
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".dot", ".gv":
+		err = lg.WriteDOT(f)
+	default:
+		err = lg.WriteGraphML(f)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", name, err)
+	}
+	return f.Close()
+}
+
+// isBroken reports whether a crawled page failed to load.
+// Pages robots.txt kept us from crawling aren't broken.
+func isBroken(n *graphNode) bool {
+	if !n.Crawled || n.Error == ErrRobotsDisallowed.Error() {
+		return false
+	}
+	return n.Status >= 400 || len(n.Error) > 0
+}
+
+// WriteBrokenLinks writes a CSV report with one row for
+// each link to a crawled page that failed to load.
+func (lg *LinkGraph) WriteBrokenLinks(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"url", "status", "error", "linked_from"})
+	for _, from := range lg.sortedURLs() {
+		for _, to := range lg.links[from] {
+			n := lg.nodes[to]
+			if !isBroken(n) {
+				continue
+			}
+			status := ""
+			if n.Status > 0 {
+				status = strconv.Itoa(n.Status)
+			}
+			cw.Write([]string{n.URL, status, n.Error, from})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteBrokenLinksFile writes the broken links report to the named file.
+func (lg *LinkGraph) WriteBrokenLinksFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", name, err)
+	}
+	defer f.Close()
+	if err := lg.WriteBrokenLinks(f); err != nil {
+		return fmt.Errorf("error writing %s: %v", name, err)
+	}
+	return f.Close()
+}
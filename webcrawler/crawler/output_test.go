@@ -0,0 +1,96 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testResults is a small crawl: the home page links to a good
+// page and a missing one, and the good page links back home.
+var testResults = []*JobResult{
+	{
+		URL:    "http://a.com/",
+		Status: 200,
+		PL: &PageLinks{Title: "Home", Links: []*Link{
+			{URL: "http://a.com/good/", Tag: "a", Attr: "href"},
+			{URL: "http://a.com/missing", Tag: "img", Attr: "src"},
+			{URL: "http://b.com", Tag: "a", Attr: "href"},
+		}},
+	},
+	{
+		URL:    "http://a.com/good",
+		Depth:  1,
+		Status: 200,
+		PL:     &PageLinks{Title: "Good", Links: []*Link{{URL: "http://a.com/#top", Tag: "a", Attr: "href"}}},
+	},
+	{
+		URL:    "http://a.com/missing",
+		Depth:  1,
+		Status: 404,
+		Error:  &StatusError{"http://a.com/missing", 404},
+	},
+}
+
+func TestResultRecord(t *testing.T) {
+	result := *testResults[2]
+	result.FetchedAt = time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	result.Duration = 1500 * time.Millisecond
+
+	buf, _ := json.Marshal(newResultRecord(&result))
+	expectedOutput := `{"url":"http://a.com/missing","status":404,` +
+		`"error":"error response status code 404 while fetching http://a.com/missing",` +
+		`"depth":1,"fetchedAt":"2018-01-02T03:04:05Z","durationMs":1500}`
+	if string(buf) != expectedOutput {
+		t.Errorf("\ngot: %s\nwant: %s", buf, expectedOutput)
+	}
+}
+
+func TestLinkGraph(t *testing.T) {
+	graph := NewLinkGraph()
+	for _, result := range testResults {
+		graph.Write(result)
+	}
+	graph.Write(&JobResult{URL: "http://a.com/private", Error: ErrRobotsDisallowed})
+
+	dot := &bytes.Buffer{}
+	if err := graph.WriteDOT(dot); err != nil {
+		t.Fatalf("error writing DOT: %v", err)
+	}
+	for _, expected := range []string{
+		`"http://a.com/" -> "http://a.com/good";`,
+		`"http://a.com/good" -> "http://a.com/";`,
+		`"http://a.com/missing" [label="http://a.com/missing", color=red];`,
+		`"http://b.com/" [label="http://b.com/", style=dashed];`,
+	} {
+		if !strings.Contains(dot.String(), expected) {
+			t.Errorf("expected DOT output to contain %s, got:\n%s", expected, dot)
+		}
+	}
+
+	graphML := &bytes.Buffer{}
+	if err := graph.WriteGraphML(graphML); err != nil {
+		t.Fatalf("error writing GraphML: %v", err)
+	}
+	for _, expected := range []string{
+		`<edge source="http://a.com/" target="http://a.com/missing"></edge>`,
+		`<data key="title">Home</data>`,
+		`<data key="status">404</data>`,
+	} {
+		if !strings.Contains(graphML.String(), expected) {
+			t.Errorf("expected GraphML output to contain %s, got:\n%s", expected, graphML)
+		}
+	}
+
+	broken := &bytes.Buffer{}
+	if err := graph.WriteBrokenLinks(broken); err != nil {
+		t.Fatalf("error writing broken links: %v", err)
+	}
+	expectedBroken := "url,status,error,linked_from\n" +
+		"http://a.com/missing,404,error response status code 404 while fetching http://a.com/missing,http://a.com/\n"
+	if broken.String() != expectedBroken {
+		t.Errorf("\ngot: %s\nwant: %s", broken, expectedBroken)
+	}
+}
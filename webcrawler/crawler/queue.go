@@ -0,0 +1,132 @@
+package crawler
+
+import (
+	"container/heap"
+	"net/url"
+)
+
+// jobQueue is a bounded priority queue of jobs. Shallower jobs
+// come out first, so the crawl is breadth first. Jobs of the same
+// depth come out by Priority, and then in the order they went in.
+//
+// Jobs for a host that is busy are parked until it isn't, so
+// a host we are already fetching as much as we may from doesn't
+// hold up the jobs for the other hosts behind it.
+type jobQueue struct {
+	items jobHeap
+	// parked holds the jobs that came to the front
+	// of the queue while their host was busy.
+	parked  map[string][]*queuedJob
+	nParked int
+	max     int
+	// seq numbers the jobs as they are pushed,
+	// to keep the queue stable within a depth.
+	seq int
+}
+
+// newJobQueue constructs a jobQueue that holds up to max jobs.
+func newJobQueue(max int) *jobQueue {
+	return &jobQueue{max: max, parked: map[string][]*queuedJob{}}
+}
+
+// Len returns the number of jobs in the queue, parked or not.
+func (q *jobQueue) Len() int {
+	return len(q.items) + q.nParked
+}
+
+// Full reports whether Push would fail.
+func (q *jobQueue) Full() bool {
+	return q.Len() >= q.max
+}
+
+// Push adds a job to the queue.
+// It returns false if the queue is full.
+func (q *jobQueue) Push(job *Job) bool {
+	if q.Full() {
+		return false
+	}
+	heap.Push(&q.items, &queuedJob{job: job, host: jobHost(job.URL), seq: q.seq})
+	q.seq++
+	return true
+}
+
+// Next removes and returns the next job whose host isn't busy,
+// parking the jobs ahead of it whose host is. It returns nil
+// if every job left is for a busy host, or there are none.
+func (q *jobQueue) Next(busy func(host string) bool) *Job {
+	for len(q.items) > 0 {
+		item := heap.Pop(&q.items).(*queuedJob)
+		if !busy(item.host) {
+			return item.job
+		}
+		q.parked[item.host] = append(q.parked[item.host], item)
+		q.nParked++
+	}
+	return nil
+}
+
+// Unpark puts the jobs parked for host back in the queue, in
+// their place, once the host may be sent another request.
+func (q *jobQueue) Unpark(host string) {
+	for _, item := range q.parked[host] {
+		heap.Push(&q.items, item)
+	}
+	q.nParked -= len(q.parked[host])
+	delete(q.parked, host)
+}
+
+// jobHost returns the host of a job's URL, as
+// HostLimiter sees it.
+func jobHost(URL string) string {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+type queuedJob struct {
+	job  *Job
+	host string
+	seq  int
+	// index is the job's place in the heap, kept up to date
+	// so it can be removed, or -1 once it is popped.
+	index int
+}
+
+// jobHeap implements heap.Interface.
+type jobHeap []*queuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].job.Depth != h[j].job.Depth {
+		return h[i].job.Depth < h[j].job.Depth
+	}
+	if h[i].job.Priority != h[j].job.Priority {
+		return h[i].job.Priority > h[j].job.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *jobHeap) Push(x interface{}) {
+	item := x.(*queuedJob)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	item.index = -1
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,397 @@
+package crawler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUserAgent is the name we crawl under, both in the
+// User-Agent header and when matching robots.txt groups.
+const DefaultUserAgent = "go-example-webcrawler"
+
+// maxRobotsBytes is how much of a robots.txt file we parse.
+// RFC 9309 requires crawlers to parse at least 500KiB.
+const maxRobotsBytes = 500 << 10
+
+// ErrRobotsDisallowed is the JobResult error for
+// URLs that robots.txt doesn't let us crawl.
+var ErrRobotsDisallowed = errors.New("disallowed by robots.txt")
+
+// robotsRule is a single Allow or Disallow line.
+type robotsRule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// robotsGroup holds the rules for one or more user agents.
+type robotsGroup struct {
+	agents     []string
+	rules      []*robotsRule
+	crawlDelay time.Duration
+}
+
+// RobotsRules is a parsed robots.txt file.
+type RobotsRules struct {
+	groups []*robotsGroup
+	// Sitemaps are the sitemap URLs listed in the file.
+	Sitemaps []string
+}
+
+// allowAll is used for hosts without a robots.txt file.
+var allowAll = &RobotsRules{}
+
+// disallowAll is used for hosts whose robots.txt file
+// we couldn't fetch because of a server error.
+var disallowAll = &RobotsRules{
+	groups: []*robotsGroup{{
+		agents: []string{"*"},
+		rules:  []*robotsRule{newRobotsRule(false, "/")},
+	}},
+}
+
+// ParseRobots parses a robots.txt file. Lines it doesn't
+// understand are ignored, so it never fails.
+func ParseRobots(r io.Reader) *RobotsRules {
+	rules := &RobotsRules{}
+	var group *robotsGroup
+	// inAgents is true while we are reading the User-agent
+	// lines at the start of a group.
+	inAgents := false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, maxRobotsBytes))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				group = &robotsGroup{}
+				rules.groups = append(rules.groups, group)
+				inAgents = true
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			// Rules before any User-agent line, and empty
+			// rules, which allow everything, are ignored.
+			if group == nil || len(value) == 0 {
+				continue
+			}
+			group.rules = append(group.rules, newRobotsRule(key == "allow", value))
+		case "crawl-delay":
+			inAgents = false
+			if group == nil {
+				continue
+			}
+			if secs, err := strconv.ParseFloat(value, 64); err == nil && secs >= 0 {
+				group.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		case "sitemap":
+			// Sitemap lines aren't tied to a group.
+			rules.Sitemaps = append(rules.Sitemaps, value)
+		}
+	}
+	return rules
+}
+
+// newRobotsRule compiles a rule pattern, where * matches any
+// sequence of characters and a trailing $ anchors the end.
+func newRobotsRule(allow bool, pattern string) *robotsRule {
+	anchored := strings.HasSuffix(pattern, "$")
+	expr := strings.TrimSuffix(pattern, "$")
+	expr = "^" + strings.Replace(regexp.QuoteMeta(expr), `\*`, ".*", -1)
+	if anchored {
+		expr += "$"
+	}
+	return &robotsRule{allow: allow, pattern: pattern, re: regexp.MustCompile(expr)}
+}
+
+// group returns the rules that apply to the user agent: the union
+// of the groups naming it, or else the union of the * groups.
+func (rr *RobotsRules) group(userAgent string) *robotsGroup {
+	// Match on the product token, "name" in "name/1.0".
+	agent := strings.ToLower(userAgent)
+	if i := strings.IndexByte(agent, '/'); i >= 0 {
+		agent = agent[:i]
+	}
+
+	specific, wildcard := &robotsGroup{}, &robotsGroup{}
+	for _, g := range rr.groups {
+		for _, a := range g.agents {
+			var merged *robotsGroup
+			if a == agent {
+				merged = specific
+			} else if a == "*" {
+				merged = wildcard
+			} else {
+				continue
+			}
+			merged.agents = append(merged.agents, a)
+			merged.rules = append(merged.rules, g.rules...)
+			if g.crawlDelay > merged.crawlDelay {
+				merged.crawlDelay = g.crawlDelay
+			}
+			break
+		}
+	}
+	if len(specific.agents) > 0 {
+		return specific
+	}
+	return wildcard
+}
+
+// Allowed reports whether the user agent may crawl the URL.
+// The longest matching rule wins, and Allow wins a tie.
+func (rr *RobotsRules) Allowed(userAgent string, u *url.URL) bool {
+	path := u.RequestURI()
+	// /robots.txt itself is always allowed.
+	if path == "/robots.txt" {
+		return true
+	}
+
+	var best *robotsRule
+	for _, rule := range rr.group(userAgent).rules {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		if best == nil || len(rule.pattern) > len(best.pattern) ||
+			(len(rule.pattern) == len(best.pattern) && rule.allow) {
+			best = rule
+		}
+	}
+	return best == nil || best.allow
+}
+
+// CrawlDelay returns the delay the user agent should
+// wait between requests, or 0 if none is given.
+func (rr *RobotsRules) CrawlDelay(userAgent string) time.Duration {
+	return rr.group(userAgent).crawlDelay
+}
+
+// robotsEntry is a cached robots.txt file. ready is closed
+// once rules is set, so concurrent lookups for the same host
+// wait for a single fetch. If that fetch is canceled, rules
+// stays nil and the entry is dropped, so the next lookup
+// fetches the file again.
+type robotsEntry struct {
+	ready chan struct{}
+	rules *RobotsRules
+}
+
+// RobotsCache fetches and caches robots.txt files per host.
+type RobotsCache struct {
+	client    *http.Client
+	userAgent string
+
+	mx      sync.Mutex
+	entries map[string]*robotsEntry
+}
+
+// NewRobotsCache constructs a new RobotsCache.
+func NewRobotsCache(userAgent string) *RobotsCache {
+	return &RobotsCache{
+		client:    &http.Client{Timeout: 10 * time.Second},
+		userAgent: userAgent,
+		entries:   map[string]*robotsEntry{},
+	}
+}
+
+// Rules returns the robots.txt rules for the URL's host,
+// fetching them the first time the host is seen. It returns
+// ctx's error if ctx is done before the rules are known.
+func (rc *RobotsCache) Rules(ctx context.Context, u *url.URL) (*RobotsRules, error) {
+	key := u.Scheme + "://" + u.Host
+	for {
+		rc.mx.Lock()
+		entry, found := rc.entries[key]
+		if !found {
+			entry = &robotsEntry{ready: make(chan struct{})}
+			rc.entries[key] = entry
+		}
+		rc.mx.Unlock()
+
+		if !found {
+			entry.rules = rc.fetch(ctx, key+"/robots.txt")
+			if entry.rules == nil {
+				rc.mx.Lock()
+				delete(rc.entries, key)
+				rc.mx.Unlock()
+			}
+			close(entry.ready)
+		}
+
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if entry.rules != nil {
+			return entry.rules, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// Someone else's fetch was canceled, so try ours.
+	}
+}
+
+// Allowed reports whether robots.txt lets us crawl the URL.
+func (rc *RobotsCache) Allowed(ctx context.Context, u *url.URL) (bool, error) {
+	rules, err := rc.Rules(ctx, u)
+	if err != nil {
+		return false, err
+	}
+	return rules.Allowed(rc.userAgent, u), nil
+}
+
+// CrawlDelay returns the Crawl-delay for the URL's host.
+func (rc *RobotsCache) CrawlDelay(ctx context.Context, u *url.URL) (time.Duration, error) {
+	rules, err := rc.Rules(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	return rules.CrawlDelay(rc.userAgent), nil
+}
+
+// Sitemaps returns the sitemap URLs listed in the robots.txt
+// file for the URL's host, or none if ctx is done first.
+func (rc *RobotsCache) Sitemaps(ctx context.Context, u *url.URL) []string {
+	rules, err := rc.Rules(ctx, u)
+	if err != nil {
+		return nil
+	}
+	return rules.Sitemaps
+}
+
+// fetch gets and parses a robots.txt file. As RFC 9309 says,
+// a missing file allows everything, and a file we can't get
+// because of a server or network error disallows everything.
+// It returns nil if ctx is done first, as that says nothing
+// about the file.
+func (rc *RobotsCache) fetch(ctx context.Context, robotsURL string) *RobotsRules {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+	if err != nil {
+		return disallowAll
+	}
+	req.Header.Set("User-Agent", rc.userAgent)
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return disallowAll
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return disallowAll
+	case resp.StatusCode >= 400:
+		return allowAll
+	case resp.StatusCode != http.StatusOK:
+		return disallowAll
+	}
+	rules := ParseRobots(resp.Body)
+	if ctx.Err() != nil {
+		// The file may have been cut short.
+		return nil
+	}
+	return rules
+}
+
+// HostLimiter spaces out requests to each host and caps
+// how many requests can be in flight to a host at once.
+// The Crawler only hands out jobs for hosts below the cap,
+// so workers don't pile up waiting here for a busy host.
+type HostLimiter struct {
+	// delay is the minimum time between requests to a host
+	// when robots.txt doesn't ask for a longer one.
+	delay time.Duration
+	// perHost is the number of concurrent requests to a host.
+	perHost int
+
+	mx    sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	next  time.Time
+	slots chan struct{}
+}
+
+// NewHostLimiter constructs a new HostLimiter.
+func NewHostLimiter(delay time.Duration, perHost int) *HostLimiter {
+	if perHost <= 0 {
+		perHost = 1
+	}
+	return &HostLimiter{
+		delay:   delay,
+		perHost: perHost,
+		hosts:   map[string]*hostState{},
+	}
+}
+
+// Wait blocks until a request to host may be sent, waiting at
+// least `delay` (or the limiter's default if that is longer)
+// since the last request to it. The returned func must be
+// called when the request is done. If ctx is done first,
+// Wait returns ctx's error and the request must not be sent.
+func (hl *HostLimiter) Wait(ctx context.Context, host string, delay time.Duration) (done func(), err error) {
+	if delay < hl.delay {
+		delay = hl.delay
+	}
+
+	hl.mx.Lock()
+	hs, found := hl.hosts[host]
+	if !found {
+		hs = &hostState{slots: make(chan struct{}, hl.perHost)}
+		hl.hosts[host] = hs
+	}
+	hl.mx.Unlock()
+
+	select {
+	case hs.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-hs.slots }
+
+	// Reserve the next free time slot for this host.
+	hl.mx.Lock()
+	now := time.Now()
+	at := hs.next
+	if at.Before(now) {
+		at = now
+	}
+	hs.next = at.Add(delay)
+	hl.mx.Unlock()
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return release, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
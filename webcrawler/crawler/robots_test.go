@@ -0,0 +1,112 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRobots = `
+# Comments and blank lines are ignored.
+Sitemap: http://example.com/sitemap.xml
+
+User-agent: *
+Disallow: /private/
+Allow: /private/public-page
+Disallow: /*.pdf$
+Crawl-delay: 2
+
+User-agent: Go-Example-Webcrawler
+User-agent: otherbot
+Disallow: /no-crawler
+Crawl-delay: 0.5
+
+User-agent: go-example-webcrawler
+Disallow: /also-no-crawler
+`
+
+func TestRobotsAllowed(t *testing.T) {
+	rules := ParseRobots(strings.NewReader(testRobots))
+
+	cases := []struct {
+		name           string
+		userAgent      string
+		path           string
+		expectedOutput bool
+	}{
+		{"no matching rule", "somebot", "/index.html", true},
+		{"disallowed prefix", "somebot", "/private/page", false},
+		{"longer allow wins", "somebot", "/private/public-page", true},
+		{"wildcard and end anchor", "somebot", "/docs/file.pdf", false},
+		{"end anchor doesn't match query", "somebot", "/docs/file.pdf?x=1", true},
+		{"robots.txt is always allowed", "somebot", "/robots.txt", true},
+		{"specific group replaces *", "go-example-webcrawler/1.0", "/private/page", true},
+		{"specific group rule", "go-example-webcrawler/1.0", "/no-crawler", false},
+		{"groups for the same agent are merged", "go-example-webcrawler", "/also-no-crawler", false},
+		{"agent in a multi-agent group", "OtherBot", "/no-crawler", false},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse("http://example.com" + c.path)
+		if output := rules.Allowed(c.userAgent, u); output != c.expectedOutput {
+			t.Errorf("\ncase: %s\ninput: %s, %s\ngot: %t\nwant: %t", c.name, c.userAgent, c.path, output, c.expectedOutput)
+		}
+	}
+}
+
+func TestRobotsCrawlDelayAndSitemaps(t *testing.T) {
+	rules := ParseRobots(strings.NewReader(testRobots))
+
+	if delay := rules.CrawlDelay("somebot"); delay != 2*time.Second {
+		t.Errorf("incorrect crawl delay for *: expected %v but got %v", 2*time.Second, delay)
+	}
+	if delay := rules.CrawlDelay(DefaultUserAgent); delay != 500*time.Millisecond {
+		t.Errorf("incorrect crawl delay for %s: expected %v but got %v", DefaultUserAgent, 500*time.Millisecond, delay)
+	}
+	expectedSitemaps := []string{"http://example.com/sitemap.xml"}
+	if !reflect.DeepEqual(rules.Sitemaps, expectedSitemaps) {
+		t.Errorf("incorrect sitemaps: expected %v but got %v", expectedSitemaps, rules.Sitemaps)
+	}
+}
+
+func TestRobotsCacheCancel(t *testing.T) {
+	release := make(chan struct{})
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			<-release
+		}
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	rc := NewRobotsCache(DefaultUserAgent)
+	u, _ := url.Parse(srv.URL + "/private")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := rc.Rules(ctx, u); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The canceled fetch isn't cached as disallowing
+	// everything: the next lookup fetches the file again.
+	allowed, err := rc.Allowed(context.Background(), u)
+	if err != nil || allowed {
+		t.Errorf("got %v, %v for /private, want it disallowed", allowed, err)
+	}
+	allowed, err = rc.Allowed(context.Background(), &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"})
+	if err != nil || !allowed {
+		t.Errorf("got %v, %v for /, want it allowed", allowed, err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("got %d fetches, want 2", n)
+	}
+}
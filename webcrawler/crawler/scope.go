@@ -0,0 +1,74 @@
+package crawler
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// anyDomain can be passed in Scope.Domains to allow every host.
+const anyDomain = "*"
+
+// SeedsOnly can be set as Scope.MaxDepth to only crawl the
+// starting URLs, since a MaxDepth of zero means no limit.
+const SeedsOnly = -1
+
+// Scope decides which links the crawler follows.
+type Scope struct {
+	// Domains are the hosts we may crawl. A domain also
+	// matches its subdomains, and "*" matches every host.
+	Domains []string
+	// MaxDepth is the number of links away from the starting
+	// URL we may go. Zero means no limit, not zero links:
+	// use SeedsOnly to only crawl the starting URLs.
+	MaxDepth int
+	// Include, if not empty, are the patterns a URL path
+	// must match at least one of.
+	Include []*regexp.Regexp
+	// Exclude are the patterns a URL path must not match.
+	Exclude []*regexp.Regexp
+	// MaxPages is the total number of pages we may crawl.
+	// Zero means no limit.
+	MaxPages int
+}
+
+// Allows reports whether a link found at `depth` links
+// away from the starting URL should be crawled.
+func (s *Scope) Allows(link *url.URL, depth int) bool {
+	if link.Scheme != "http" && link.Scheme != "https" {
+		return false
+	}
+	if s.MaxDepth < 0 && depth > 0 || s.MaxDepth > 0 && depth > s.MaxDepth {
+		return false
+	}
+	if !s.allowsHost(link.Hostname()) {
+		return false
+	}
+	if len(s.Include) > 0 && !matchesAny(s.Include, link.Path) {
+		return false
+	}
+	return !matchesAny(s.Exclude, link.Path)
+}
+
+// allowsHost reports whether host is one of the
+// Domains or a subdomain of one of them.
+func (s *Scope) allowsHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, d := range s.Domains {
+		d = strings.ToLower(d)
+		if d == anyDomain || host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether s matches any of the patterns.
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
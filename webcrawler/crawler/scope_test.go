@@ -0,0 +1,52 @@
+package crawler
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestScopeAllows(t *testing.T) {
+	scope := &Scope{
+		Domains:  []string{"example.com"},
+		MaxDepth: 2,
+		Include:  []*regexp.Regexp{regexp.MustCompile("^/docs/")},
+		Exclude:  []*regexp.Regexp{regexp.MustCompile(`\.pdf$`)},
+	}
+
+	cases := []struct {
+		name           string
+		link           string
+		depth          int
+		expectedOutput bool
+	}{
+		{"in scope", "http://example.com/docs/a", 1, true},
+		{"subdomain", "https://www.example.com/docs/a", 1, true},
+		{"host is case insensitive", "http://EXAMPLE.com/docs/a", 1, true},
+		{"other host", "http://example.org/docs/a", 1, false},
+		{"host suffix is not a subdomain", "http://badexample.com/docs/a", 1, false},
+		{"too deep", "http://example.com/docs/a", 3, false},
+		{"not included", "http://example.com/blog/a", 1, false},
+		{"excluded", "http://example.com/docs/a.pdf", 1, false},
+		{"not http", "mailto:someone@example.com", 1, false},
+	}
+
+	for _, c := range cases {
+		link, _ := url.Parse(c.link)
+		if output := scope.Allows(link, c.depth); output != c.expectedOutput {
+			t.Errorf("\ncase: %s\ninput: %s, %d\ngot: %t\nwant: %t", c.name, c.link, c.depth, output, c.expectedOutput)
+		}
+	}
+}
+
+func TestScopeAllowsAnyDomain(t *testing.T) {
+	scope := &Scope{Domains: []string{anyDomain}}
+	link, _ := url.Parse("http://anywhere.example.net/x")
+	if !scope.Allows(link, 100) {
+		t.Errorf("expected %s to be allowed with no limits", link)
+	}
+	scope.MaxDepth = SeedsOnly
+	if !scope.Allows(link, 0) || scope.Allows(link, 1) {
+		t.Errorf("expected only depth 0 to be allowed with SeedsOnly")
+	}
+}
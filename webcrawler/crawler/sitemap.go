@@ -0,0 +1,125 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSitemapBytes is the largest sitemap we read, after
+// decompressing it. It is the limit set by sitemaps.org.
+const maxSitemapBytes = 50 << 20
+
+// defaultPriority is the priority of a sitemap
+// entry that doesn't give one, as sitemaps.org says.
+const defaultPriority = 0.5
+
+// lastModLayouts are the W3C Datetime formats that
+// sitemaps use for lastmod, from most to least precise.
+// time.RFC3339 also accepts fractions of a second.
+var lastModLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+// Sitemap is a parsed sitemap file. A sitemap either lists
+// pages, or is a sitemap index listing other sitemaps.
+type Sitemap struct {
+	// Pages are the pages listed in the sitemap, as jobs
+	// with the LastMod and Priority the sitemap gives.
+	Pages []*Job
+	// Sitemaps are the URLs listed in a sitemap index.
+	Sitemaps []string
+}
+
+// sitemapXML is the XML form of both a <urlset> and a
+// <sitemapindex>: only one of the lists is ever filled.
+type sitemapXML struct {
+	URLs []struct {
+		Loc      string `xml:"loc"`
+		LastMod  string `xml:"lastmod"`
+		Priority string `xml:"priority"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// ParseSitemap parses a sitemap or sitemap index,
+// decompressing it first if it is gzipped.
+func ParseSitemap(r io.Reader) (*Sitemap, error) {
+	// Sniff for the gzip magic number rather than trusting the
+	// URL or the Content-Type, which are often wrong for sitemaps.
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing sitemap: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	var sx sitemapXML
+	if err := xml.NewDecoder(io.LimitReader(r, maxSitemapBytes)).Decode(&sx); err != nil {
+		return nil, fmt.Errorf("error parsing sitemap: %v", err)
+	}
+
+	sitemap := &Sitemap{}
+	for _, u := range sx.URLs {
+		loc := strings.TrimSpace(u.Loc)
+		if len(loc) == 0 {
+			continue
+		}
+		job := &Job{URL: loc, Priority: defaultPriority}
+		if lastMod, ok := parseLastMod(u.LastMod); ok {
+			job.LastMod = &lastMod
+		}
+		if p, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64); err == nil && p >= 0 && p <= 1 {
+			job.Priority = p
+		}
+		sitemap.Pages = append(sitemap.Pages, job)
+	}
+	for _, s := range sx.Sitemaps {
+		if loc := strings.TrimSpace(s.Loc); len(loc) > 0 {
+			sitemap.Sitemaps = append(sitemap.Sitemaps, loc)
+		}
+	}
+	return sitemap, nil
+}
+
+// parseLastMod parses a lastmod value, and
+// reports whether it was in a format we know.
+func parseLastMod(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range lastModLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// GetSitemap fetches and parses the sitemap at URL.
+func (f *Fetcher) GetSitemap(ctx context.Context, URL string) (*Sitemap, error) {
+	resp, err := f.do(ctx, URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL, resp.StatusCode}
+	}
+	return ParseSitemap(resp.Body)
+}
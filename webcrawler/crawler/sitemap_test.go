@@ -0,0 +1,138 @@
+package crawler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSitemap(t *testing.T) {
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url>
+		<loc> http://a.com/ </loc>
+		<lastmod>2018-01-02</lastmod>
+		<priority>1.0</priority>
+	</url>
+	<url>
+		<loc>http://a.com/about</loc>
+		<lastmod>2018-01-02T03:04:05.5+01:00</lastmod>
+	</url>
+	<url>
+		<loc>http://a.com/bad</loc>
+		<lastmod>yesterday</lastmod>
+		<priority>2</priority>
+	</url>
+	<url><loc></loc></url>
+</urlset>`
+	date := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	datetime := time.Date(2018, 1, 2, 2, 4, 5, 5e8, time.UTC)
+
+	sitemap, err := ParseSitemap(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedPages := []*Job{
+		{URL: "http://a.com/", LastMod: &date, Priority: 1},
+		{URL: "http://a.com/about", LastMod: &datetime, Priority: defaultPriority},
+		{URL: "http://a.com/bad", Priority: defaultPriority},
+	}
+	if len(sitemap.Pages) != len(expectedPages) {
+		t.Fatalf("got %d pages, want %d", len(sitemap.Pages), len(expectedPages))
+	}
+	for i, got := range sitemap.Pages {
+		want := expectedPages[i]
+		sameLastMod := (got.LastMod == nil) == (want.LastMod == nil) &&
+			(got.LastMod == nil || got.LastMod.Equal(*want.LastMod))
+		if got.URL != want.URL || got.Priority != want.Priority || !sameLastMod {
+			t.Errorf("\ngot: %+v (lastmod %v)\nwant: %+v (lastmod %v)", got, got.LastMod, want, want.LastMod)
+		}
+	}
+	if len(sitemap.Sitemaps) != 0 {
+		t.Errorf("got sitemaps %v in a urlset", sitemap.Sitemaps)
+	}
+}
+
+func TestParseSitemapIndex(t *testing.T) {
+	input := `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>http://a.com/sitemap1.xml</loc></sitemap>
+	<sitemap><loc>http://a.com/sitemap2.xml.gz</loc><lastmod>2018-01-02</lastmod></sitemap>
+</sitemapindex>`
+
+	// The same index should parse whether or not it's gzipped.
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	gz.Write([]byte(input))
+	gz.Close()
+
+	want := []string{"http://a.com/sitemap1.xml", "http://a.com/sitemap2.xml.gz"}
+	for _, r := range []*bytes.Reader{bytes.NewReader([]byte(input)), bytes.NewReader(gzipped.Bytes())} {
+		sitemap, err := ParseSitemap(r)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(sitemap.Sitemaps, want) {
+			t.Errorf("\ngot: %v\nwant: %v", sitemap.Sitemaps, want)
+		}
+		if len(sitemap.Pages) != 0 {
+			t.Errorf("got pages %v in a sitemap index", sitemap.Pages)
+		}
+	}
+}
+
+func TestCrawlerSitemaps(t *testing.T) {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "User-agent: *\nDisallow: /private\nSitemap: %s/sitemap_index.xml\n", srv.URL)
+	})
+	mux.HandleFunc("/sitemap_index.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<sitemapindex><sitemap><loc>%s/sitemap.xml.gz</loc></sitemap>`+
+			`<sitemap><loc>%s/missing.xml</loc></sitemap></sitemapindex>`, srv.URL, srv.URL)
+	})
+	mux.HandleFunc("/sitemap.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		gz := gzip.NewWriter(w)
+		fmt.Fprintf(gz, `<urlset><url><loc>%s/orphan</loc></url>`+
+			`<url><loc>%s/</loc></url>`+
+			`<url><loc>http://example.com/</loc></url></urlset>`, srv.URL, srv.URL)
+		gz.Close()
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/", "/orphan":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html></html>")
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	sink := &collectSink{}
+	crawler := New(Config{
+		Seeds:          []string{srv.URL + "/"},
+		RobotsSitemaps: true,
+		Scope:          &Scope{Domains: []string{"127.0.0.1"}},
+		Robots:         NewRobotsCache(DefaultUserAgent),
+		Sinks:          []Sink{sink},
+	})
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sort.Strings(sink.urls)
+	want := []string{srv.URL + "/", srv.URL + "/orphan"}
+	if !reflect.DeepEqual(sink.urls, want) {
+		t.Errorf("\ngot: %v\nwant: %v", sink.urls, want)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// regexpList is a flag.Value that collects a regular
+// expression each time the flag is repeated.
+type regexpList []*regexp.Regexp
+
+func (rl *regexpList) String() string {
+	if rl == nil {
+		return ""
+	}
+	patterns := make([]string, len(*rl))
+	for i, r := range *rl {
+		patterns[i] = r.String()
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (rl *regexpList) Set(pattern string) error {
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	*rl = append(*rl, r)
+	return nil
+}
+
+// stringList is a flag.Value that collects a
+// string each time the flag is repeated.
+type stringList []string
+
+func (sl *stringList) String() string {
+	if sl == nil {
+		return ""
+	}
+	return strings.Join(*sl, " ")
+}
+
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
+}
@@ -1,95 +1,238 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zicodeng/go-example/webcrawler/crawler"
 )
 
 const usage = `
 usage:
-	webcrawler <starting-url>
-`
+	webcrawler [flags] <starting-url>
+	webcrawler [flags] -resume <state-dir>
 
-type JobResult struct {
-	URL   string
-	PL    *PageLinks
-	Error error
-}
+flags:
+`
 
-func reportResults(result *JobResult, results chan *JobResult) {
-	log.Printf("reporting results for %s", result.URL)
-	// Hand it to results goroutine to crawl all links
-	// found in this result.
-	results <- result
+// openFrontier opens the frontier to resume from, or to save
+// a new crawl in, or returns an in-memory one if neither is set.
+func openFrontier(stateDir, resumeDir string) (*crawler.Frontier, error) {
+	switch {
+	case len(stateDir) > 0 && len(resumeDir) > 0:
+		return nil, fmt.Errorf("use either -state or -resume, not both")
+	case len(resumeDir) > 0:
+		return crawler.OpenFrontier(resumeDir)
+	case len(stateDir) > 0:
+		return crawler.OpenFrontier(stateDir)
+	default:
+		return crawler.NewFrontier(), nil
+	}
 }
 
-func startWorking(toFetch chan string, results chan *JobResult) {
-	for URL := range toFetch {
-		log.Printf("crawling %s", URL)
-		links, err := GetPageLinks(URL)
-		result := &JobResult{URL, links, err}
-		go reportResults(result, results)
+func main() {
+	scope := &crawler.Scope{}
+	domains := flag.String("domains", "", "comma-separated domains to crawl, or * for any (default: the starting URL's host)")
+	maxDepth := flag.Int("max-depth", -1, "maximum number of links to follow from the starting URL, 0 for only the starting URL, -1 for no limit")
+	flag.IntVar(&scope.MaxPages, "max-pages", 0, "maximum number of pages to crawl, 0 for no limit")
+	flag.Var((*regexpList)(&scope.Include), "include", "only crawl URL paths matching this regexp (repeatable)")
+	flag.Var((*regexpList)(&scope.Exclude), "exclude", "never crawl URL paths matching this regexp (repeatable)")
+	// -per-host is the main throttle: -workers only
+	// caps the number of requests across all hosts.
+	workers := flag.Int("workers", 100, "maximum number of pages to fetch concurrently, across all hosts")
+	queueSize := flag.Int("queue-size", 10000, "number of pending pages to keep in memory")
+	var sitemaps []string
+	flag.Var((*stringList)(&sitemaps), "sitemap", "also crawl the pages listed in this sitemap or sitemap index (repeatable)")
+	robotsSitemaps := flag.Bool("robots-sitemaps", false, "also crawl the pages listed in the sitemaps from robots.txt")
+	ignoreRobots := flag.Bool("ignore-robots", false, "don't fetch or obey robots.txt")
+	delay := flag.Duration("delay", time.Second, "minimum delay between requests to the same host")
+	perHost := flag.Int("per-host", 2, "maximum concurrent requests and connections to the same host")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout for each request")
+	userAgent := flag.String("user-agent", crawler.DefaultUserAgent, "User-Agent header to send")
+	retries := flag.Int("retries", 3, "times to retry a request that got a 429 or 5xx response, -1 for none")
+	maxBody := flag.Int64("max-body", 10<<20, "maximum number of bytes to read from each page")
+	cacheFile := flag.String("cache", "", "file to keep page validators in, to make conditional requests when crawling again")
+	stateDir := flag.String("state", "", "directory to save the crawl state in, so it can be resumed")
+	resumeDir := flag.String("resume", "", "resume the crawl saved in this directory")
+	checkpointInterval := flag.Duration("checkpoint-interval", 30*time.Second, "how often to checkpoint the crawl state")
+	outFile := flag.String("out", "", "write each result as a line of JSON to this file, or - for standard output")
+	graphFile := flag.String("graph", "", "write the link graph to this file when done, as DOT if it ends in .dot, or else GraphML")
+	brokenFile := flag.String("broken", "", "write a CSV report of broken links to this file when done")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics at /metrics and the crawl status at /status on this address")
+	logLevel := flag.String("log-level", "info", "minimum level to log: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
 	}
-}
+	flag.Parse()
 
-// numWorkers is the number of worker goroutines
-// we will start: begin with just 1 and increase
-// to see the benefits of concurrent execution,
-// but don't increase beyond the number of concurrent
-// socket connections allowed by your OS.
-const numWorkers = 100
+	// Scope counts a MaxDepth of zero as no limit,
+	// so only the starting URL needs a sentinel.
+	switch {
+	case *maxDepth == 0:
+		scope.MaxDepth = crawler.SeedsOnly
+	case *maxDepth > 0:
+		scope.MaxDepth = *maxDepth
+	}
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println(usage)
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	slog.SetDefault(logger)
 
-	// Use the first argument as our starting URL.
-	startingURL := os.Args[1]
+	frontier, err := openFrontier(*stateDir, *resumeDir)
+	if err != nil {
+		fatal("error opening crawl state", "err", err)
+	}
+	defer frontier.Close()
 
-	// toFetch is a channel that gets page links
-	// for a given URL.
-	toFetch := make(chan string)
-	// results is a channel that reports page link result.
-	results := make(chan *JobResult)
-	seen := map[string]bool{}
+	// Use the first argument as our starting URL,
+	// unless we are resuming a crawl.
+	startingURL := frontier.StartURL()
+	if len(*resumeDir) == 0 {
+		if flag.NArg() < 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if len(startingURL) > 0 {
+			fatal("the state directory already has a crawl in it, use -resume to continue it", "dir", *stateDir)
+		}
+		startingURL = flag.Arg(0)
+	} else if len(startingURL) == 0 {
+		fatal("no crawl to resume", "dir", *resumeDir)
+	} else {
+		slog.Info("resuming crawl", "url", startingURL, "pending", frontier.NumPending())
+	}
 
-	// Build a concurrent web crawler
-	// with `numWorkers` worker goroutines.
-	for i := 0; i < numWorkers; i++ {
-		go startWorking(toFetch, results)
+	start, err := url.Parse(startingURL)
+	if err != nil || !start.IsAbs() {
+		fatal("invalid starting URL", "url", startingURL)
+	}
+	if len(*domains) > 0 {
+		scope.Domains = strings.Split(*domains, ",")
+	} else {
+		scope.Domains = []string{start.Hostname()}
 	}
 
-	seen[startingURL] = true
-	toFetch <- startingURL
+	var sinks []crawler.Sink
+	if len(*outFile) > 0 {
+		sink, err := crawler.NewJSONLinesSink(*outFile)
+		if err != nil {
+			fatal("error opening output", "err", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	var graph *crawler.LinkGraph
+	if len(*graphFile) > 0 || len(*brokenFile) > 0 {
+		graph = crawler.NewLinkGraph()
+		sinks = append(sinks, graph)
+	}
 
-	outstandingJobs := 1
+	var robots *crawler.RobotsCache
+	if !*ignoreRobots {
+		robots = crawler.NewRobotsCache(*userAgent)
+	}
 
-	// The JobResult we receive might contain many other page links,
-	// we need to crawl those as well.
-	for result := range results {
-		outstandingJobs--
-		if result.Error != nil {
-			log.Printf("error crawling %s: %v", result.URL, result.Error)
-		} else {
-			log.Printf("processing %d links found in %s", len(result.PL.Links), result.URL)
-			// Follow all the links found in this page,
-			// and add them to toFetch channel, which will be handled
-			// by different goroutine.
-			for _, URL := range result.PL.Links {
-				if !seen[URL] {
-					seen[URL] = true
-					log.Printf("adding %s to the queue", URL)
-					toFetch <- URL
-					outstandingJobs++
-				}
+	var cache *crawler.PageCache
+	if len(*cacheFile) > 0 {
+		cache, err = crawler.OpenPageCache(*cacheFile)
+		if err != nil {
+			fatal("error opening page cache", "err", err)
+		}
+	}
+	metrics := crawler.NewMetrics()
+	if len(*metricsAddr) > 0 {
+		srv := &http.Server{Addr: *metricsAddr, Handler: metrics.Handler()}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("error serving metrics", "err", err)
 			}
+		}()
+		defer srv.Close()
+		slog.Info("serving metrics", "addr", *metricsAddr)
+	}
+
+	fetcher := crawler.NewFetcher(crawler.FetcherConfig{
+		Timeout:         *timeout,
+		UserAgent:       *userAgent,
+		MaxRetries:      *retries,
+		MaxBodyBytes:    *maxBody,
+		MaxConnsPerHost: *perHost,
+		Cache:           cache,
+		Metrics:         metrics,
+	})
+
+	c := crawler.New(crawler.Config{
+		Seeds:              []string{startingURL},
+		Sitemaps:           sitemaps,
+		RobotsSitemaps:     *robotsSitemaps,
+		Scope:              scope,
+		PerHost:            *perHost,
+		Workers:            *workers,
+		QueueSize:          *queueSize,
+		Robots:             robots,
+		Limiter:            crawler.NewHostLimiter(*delay, *perHost),
+		Fetcher:            fetcher,
+		Frontier:           frontier,
+		CheckpointInterval: *checkpointInterval,
+		Sinks:              sinks,
+		Metrics:            metrics,
+		Logger:             logger,
+	})
+
+	// The first Ctrl-C lets the pages being fetched finish,
+	// stop() then restores the default so a second one quits.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	runErr := c.Run(ctx)
+
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			fatal("error closing output", "err", err)
+		}
+	}
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			fatal("error saving page cache", "err", err)
 		}
-		if outstandingJobs == 0 {
-			break
+	}
+	if len(*graphFile) > 0 {
+		if err := graph.WriteGraphFile(*graphFile); err != nil {
+			fatal("error writing link graph", "err", err)
+		}
+	}
+	if len(*brokenFile) > 0 {
+		if err := graph.WriteBrokenLinksFile(*brokenFile); err != nil {
+			fatal("error writing broken links report", "err", err)
 		}
 	}
-	log.Println("ALL DONE!")
+
+	if runErr == context.Canceled {
+		if len(*stateDir) > 0 || len(*resumeDir) > 0 {
+			slog.Warn("interrupted, run again with -resume to continue")
+		} else {
+			slog.Warn("interrupted")
+		}
+		os.Exit(1)
+	}
+	if runErr != nil {
+		fatal("error crawling", "err", runErr)
+	}
+	st := metrics.Status()
+	slog.Info("ALL DONE!", "pages", st.PagesFetched, "bytes", st.Bytes, "elapsed", time.Since(st.StartedAt).Round(time.Millisecond))
 }
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Where TokenAuthenticator looks for tokens.
+const (
+	// TokenParam is the query parameter holding a token.
+	TokenParam = "access_token"
+	// BearerProtocol is the WebSocket subprotocol that says
+	// the next subprotocol is a token. Browsers can't set
+	// an Authorization header on a WebSocket, but they can
+	// set Sec-WebSocket-Protocol:
+	//
+	//	new WebSocket(url, ["bearer", token])
+	BearerProtocol = "bearer"
+	// DefaultCookieName is the cookie holding a token.
+	DefaultCookieName = "session"
+)
+
+// ErrUnauthorized is the error returned when a request
+// has no token, or its token isn't valid.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator identifies the user making a WebSocket upgrade request.
+type Authenticator interface {
+	// Authenticate returns the user making r, or an
+	// error if it can't tell who that is.
+	Authenticate(r *http.Request) (user string, err error)
+}
+
+// TokenAuthenticator authenticates requests with tokens
+// signed with a secret key, which it looks for in the
+// access_token query parameter, then the Authorization
+// header, then the subprotocols, then a cookie.
+//
+// A token is the user and its expiry time, signed with
+// HMAC-SHA256, so no session store is needed to check it.
+type TokenAuthenticator struct {
+	key        []byte
+	cookieName string
+	now        func() time.Time
+}
+
+// NewTokenAuthenticator constructs a new TokenAuthenticator that
+// signs tokens with key, and reads them from the named cookie,
+// or DefaultCookieName if cookieName is empty.
+func NewTokenAuthenticator(key []byte, cookieName string) *TokenAuthenticator {
+	if len(cookieName) == 0 {
+		cookieName = DefaultCookieName
+	}
+	return &TokenAuthenticator{key: key, cookieName: cookieName, now: time.Now}
+}
+
+// Sign returns a token for user that is valid until expires.
+func (ta *TokenAuthenticator) Sign(user string, expires time.Time) string {
+	payload := []byte(user + ":" + strconv.FormatInt(expires.Unix(), 10))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(ta.mac(payload))
+}
+
+// Verify returns the user of token, or ErrUnauthorized if the
+// token wasn't signed with our key or has expired.
+func (ta *TokenAuthenticator) Verify(token string) (string, error) {
+	encPayload, encSig, found := strings.Cut(token, ".")
+	if !found {
+		return "", ErrUnauthorized
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return "", ErrUnauthorized
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	// hmac.Equal takes the same time however many bytes
+	// match, so the signature can't be guessed byte by byte.
+	if err != nil || !hmac.Equal(sig, ta.mac(payload)) {
+		return "", ErrUnauthorized
+	}
+
+	// The user can contain a colon, but the expiry can't.
+	i := strings.LastIndexByte(string(payload), ':')
+	if i < 0 {
+		return "", ErrUnauthorized
+	}
+	expires, err := strconv.ParseInt(string(payload[i+1:]), 10, 64)
+	if err != nil || ta.now().Unix() >= expires {
+		return "", ErrUnauthorized
+	}
+	return string(payload[:i]), nil
+}
+
+func (ta *TokenAuthenticator) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, ta.key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// Cookie returns a cookie holding a token for user,
+// valid until expires.
+func (ta *TokenAuthenticator) Cookie(user string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     ta.cookieName,
+		Value:    ta.Sign(user, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// Authenticate implements the Authenticator interface.
+func (ta *TokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	if token := r.URL.Query().Get(TokenParam); len(token) > 0 {
+		return ta.Verify(token)
+	}
+	// Clients other than browsers can send the token
+	// the usual way, as for any other request.
+	if scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " "); found && strings.EqualFold(scheme, BearerProtocol) {
+		return ta.Verify(token)
+	}
+	if token, found := bearerToken(r); found {
+		return ta.Verify(token)
+	}
+	if cookie, err := r.Cookie(ta.cookieName); err == nil {
+		return ta.Verify(cookie.Value)
+	}
+	return "", ErrUnauthorized
+}
+
+// bearerToken returns the token following the
+// bearer subprotocol in the request, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == BearerProtocol && i+1 < len(protocols) {
+			return protocols[i+1], true
+		}
+	}
+	return "", false
+}
+
+// checkOrigin returns a function for websocket.Upgrader.CheckOrigin
+// that accepts requests from the same origin, from the allowed
+// origins, and without an Origin header, which only browsers send.
+// An allowed origin of "*" accepts every origin.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	origins := map[string]bool{}
+	for _, origin := range allowed {
+		origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 || origins["*"] || origins[strings.ToLower(origin)] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	ta := NewTokenAuthenticator([]byte("secret"), "")
+	ta.now = func() time.Time { return now }
+	other := NewTokenAuthenticator([]byte("other secret"), "")
+
+	valid := ta.Sign("alice", now.Add(time.Hour))
+	payload, sig, _ := strings.Cut(valid, ".")
+	// Mallory's token with Alice's signature.
+	malloryPayload, _, _ := strings.Cut(ta.Sign("mallory", now.Add(time.Hour)), ".")
+	forged := malloryPayload + "." + sig
+
+	cases := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"valid", valid, "alice"},
+		{"colon in user", ta.Sign("a:b", now.Add(time.Hour)), "a:b"},
+		{"expired", ta.Sign("alice", now), ""},
+		{"other key", other.Sign("alice", now.Add(time.Hour)), ""},
+		{"forged payload", forged, ""},
+		{"no signature", payload, ""},
+		{"not base64", "!!!.!!!", ""},
+		{"empty", "", ""},
+	}
+	for _, c := range cases {
+		got, err := ta.Verify(c.token)
+		if got != c.want || (err != nil) != (len(c.want) == 0) {
+			t.Errorf("\ncase: %s\ngot: %q, %v\nwant: %q", c.name, got, err, c.want)
+		}
+		if err != nil && err != ErrUnauthorized {
+			t.Errorf("\ncase: %s\ngot error %v, want ErrUnauthorized", c.name, err)
+		}
+	}
+}
+
+func TestWebSocketsHandlerAuth(t *testing.T) {
+	auth := NewTokenAuthenticator([]byte("secret"), "")
+	n := NewNotifier()
+	srv := httptest.NewServer(NewWebSocketsHandler(n, WebSocketsConfig{
+		AllowedOrigins: []string{"https://dash.example.com/"},
+		Auth:           auth,
+	}))
+	defer srv.Close()
+	URL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	token := auth.Sign("alice", time.Now().Add(time.Hour))
+	cookie := auth.Cookie("alice", time.Now().Add(time.Hour)).String()
+	cases := []struct {
+		name       string
+		query      string
+		header     http.Header
+		wantStatus int
+	}{
+		{"no token", "", nil, http.StatusUnauthorized},
+		{"bad token", "?" + TokenParam + "=bad", nil, http.StatusUnauthorized},
+		{"query token", "?" + TokenParam + "=" + url.QueryEscape(token), nil, http.StatusSwitchingProtocols},
+		{"authorization header", "", http.Header{"Authorization": {"Bearer " + token}}, http.StatusSwitchingProtocols},
+		{"bearer protocol", "", http.Header{"Sec-Websocket-Protocol": {BearerProtocol + ", " + token}}, http.StatusSwitchingProtocols},
+		{"cookie", "", http.Header{"Cookie": {cookie}}, http.StatusSwitchingProtocols},
+		{"allowed origin", "", http.Header{"Cookie": {cookie}, "Origin": {"https://DASH.example.com"}}, http.StatusSwitchingProtocols},
+		{"same origin", "", http.Header{"Cookie": {cookie}, "Origin": {srv.URL}}, http.StatusSwitchingProtocols},
+		{"other origin", "", http.Header{"Cookie": {cookie}, "Origin": {"https://evil.example.com"}}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		conn, resp, err := websocket.DefaultDialer.Dial(URL+c.query, c.header)
+		if resp == nil {
+			t.Errorf("\ncase: %s\nunexpected error: %v", c.name, err)
+			continue
+		}
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("\ncase: %s\ngot status: %d\nwant: %d", c.name, resp.StatusCode, c.wantStatus)
+		}
+		if conn == nil {
+			continue
+		}
+		// The bearer subprotocol is echoed, as browsers require.
+		if c.header.Get("Sec-Websocket-Protocol") != "" && conn.Subprotocol() != BearerProtocol {
+			t.Errorf("\ncase: %s\ngot subprotocol %q, want %q", c.name, conn.Subprotocol(), BearerProtocol)
+		}
+		conn.Close()
+	}
+}
+
+func TestNotifyUser(t *testing.T) {
+	auth := NewTokenAuthenticator([]byte("secret"), "")
+	n := NewNotifier()
+	srv := httptest.NewServer(NewWebSocketsHandler(n, WebSocketsConfig{Auth: auth}))
+	defer srv.Close()
+
+	dialAs := func(user string) *websocket.Conn {
+		token := auth.Sign(user, time.Now().Add(time.Hour))
+		URL := "ws" + strings.TrimPrefix(srv.URL, "http") + "?" + TokenParam + "=" + url.QueryEscape(token)
+		conn, _, err := websocket.DefaultDialer.Dial(URL, nil)
+		if err != nil {
+			t.Fatalf("error dialing as %s: %v", user, err)
+		}
+		control(t, conn, ActionSubscribe, "builds")
+		return conn
+	}
+	alice, bob := dialAs("alice"), dialAs("bob")
+	defer alice.Close()
+	defer bob.Close()
+
+	if err := n.NotifyUser("alice", "builds", []byte(`"for alice"`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := n.NotifyUser("", "builds", []byte(`"for nobody"`)); err == nil {
+		t.Errorf("got no error notifying no user")
+	}
+	n.Notify("builds", []byte(`"for everyone"`))
+
+	if got := readMessage(t, alice); string(got.Payload) != `"for alice"` {
+		t.Errorf("alice got %+v, want her event", got)
+	}
+	if got := readMessage(t, bob); string(got.Payload) != `"for everyone"` {
+		t.Errorf("bob got %+v, want only the event for everyone", got)
+	}
+}
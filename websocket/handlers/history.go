@@ -0,0 +1,52 @@
+package handlers
+
+// historyEvent is an event kept in the history, so it
+// can be sent again to clients that missed it.
+type historyEvent struct {
+	id    uint64
+	user  string
+	topic string
+	msg   []byte
+}
+
+// history is a ring buffer of the most recent events,
+// oldest first. When it is full, adding an event
+// overwrites the oldest one.
+type history struct {
+	events []*historyEvent
+	// start is the index of the oldest event,
+	// and count the number of events.
+	start int
+	count int
+}
+
+// newHistory constructs a new history that keeps size events.
+func newHistory(size int) *history {
+	return &history{events: make([]*historyEvent, size)}
+}
+
+// add adds ev as the newest event.
+func (h *history) add(ev *historyEvent) {
+	if len(h.events) == 0 {
+		return
+	}
+	end := (h.start + h.count) % len(h.events)
+	h.events[end] = ev
+	if h.count < len(h.events) {
+		h.count++
+	} else {
+		// We just overwrote the oldest event.
+		h.start = (h.start + 1) % len(h.events)
+	}
+}
+
+// since returns the events with IDs greater than id, oldest first.
+func (h *history) since(id uint64) []*historyEvent {
+	var events []*historyEvent
+	for i := 0; i < h.count; i++ {
+		if ev := h.events[(h.start+i)%len(h.events)]; ev.id > id {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
@@ -1,36 +1,73 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// WebSocketsConfig configures a WebSocketsHandler.
+type WebSocketsConfig struct {
+	// AllowedOrigins are the origins, like "https://example.com",
+	// of the pages allowed to connect besides our own. "*" allows
+	// any page to connect.
+	AllowedOrigins []string
+	// Auth identifies the user making each upgrade request.
+	// Requests it can't identify are refused. If it is nil,
+	// anyone can connect, anonymously.
+	Auth Authenticator
+}
+
 // WebSocketsHandler is a handler for WebSocket upgrade requests.
 type WebSocketsHandler struct {
 	notifier *Notifier
 	upgrader *websocket.Upgrader
+	auth     Authenticator
 }
 
 // NewWebSocketsHandler constructs a new WebSocketsHandler.
-func NewWebSocketsHandler(notifier *Notifier) *WebSocketsHandler {
+func NewWebSocketsHandler(notifier *Notifier, config WebSocketsConfig) *WebSocketsHandler {
 	return &WebSocketsHandler{
 		notifier: notifier,
 		upgrader: &websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
+			// Browsers send cookies with WebSocket requests from
+			// any page, so without this check any site could
+			// connect as the user.
+			CheckOrigin: checkOrigin(config.AllowedOrigins),
+			// A client passing a token as a subprotocol must
+			// get the bearer subprotocol back, or the browser
+			// drops the connection.
+			Subprotocols: []string{BearerProtocol},
 		},
+		auth: config.Auth,
 	}
 }
 
 // ServeHTTP implements the http.Handler interface for the WebSocketsHandler.
 func (wsh *WebSocketsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("received websocket upgrade request")
+	// Find out who the client is before upgrading,
+	// while we can still respond with an HTTP error.
+	user := ""
+	if wsh.auth != nil {
+		var err error
+		if user, err = wsh.auth.Authenticate(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
 	// Upgrade the connection to a WebSocket, and add the
-	// new websock.Conn to the Notifier.
+	// new websock.Conn to the Notifier. Upgrade responds
+	// with 403 Forbidden if the origin isn't allowed.
 	conn, err := wsh.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
@@ -43,100 +80,400 @@ func (wsh *WebSocketsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	// Note that we don't want to spawn a new goroutine here
 	// because the expectation is that this upgrade request never ends,
 	// as the connection is upgraded into a persistent Websocket connection.
-	wsh.notifier.AddClient(conn)
+	wsh.notifier.AddClient(conn, user)
+}
+
+// Messages sent to clients are JSON objects with a type:
+//
+//	{"type": "event", "id": 42, "topic": "builds", "payload": {...}}
+//	{"type": "subscribed", "topic": "builds"}
+//	{"type": "unsubscribed", "topic": "builds"}
+//	{"type": "error", "error": "..."}
+//
+// Clients only receive the events of the topics they
+// subscribe to, by sending control messages:
+//
+//	{"action": "subscribe", "topic": "builds"}
+//	{"action": "unsubscribe", "topic": "builds"}
+//
+// Event IDs increase with each event. A client that
+// reconnects can subscribe with the ID of the last event
+// it got, to have the events it missed sent first:
+//
+//	{"action": "subscribe", "topic": "builds", "last_event_id": 42}
+//
+// If some of them are too old to be kept any longer, the
+// subscribed message says so with "truncated": true.
+const (
+	MessageEvent        = "event"
+	MessageSubscribed   = "subscribed"
+	MessageUnsubscribed = "unsubscribed"
+	MessageError        = "error"
+
+	ActionSubscribe   = "subscribe"
+	ActionUnsubscribe = "unsubscribe"
+)
+
+// Message is a message sent to a client.
+type Message struct {
+	Type      string          `json:"type"`
+	ID        uint64          `json:"id,omitempty"`
+	Topic     string          `json:"topic,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// ControlMessage is a message sent by a client
+// to change what it is subscribed to.
+type ControlMessage struct {
+	Action      string `json:"action"`
+	Topic       string `json:"topic"`
+	LastEventID uint64 `json:"last_event_id,omitempty"`
+}
+
+// Defaults for the Notifier.
+const (
+	// defaultQueueSize is how many messages can wait to be
+	// written to a client before it is disconnected.
+	defaultQueueSize = 256
+	// defaultWriteWait is how long writing a message
+	// to a client may take.
+	defaultWriteWait = 10 * time.Second
+	// defaultPongWait is how long a client may go without
+	// answering a ping before it is considered dead.
+	defaultPongWait = 60 * time.Second
+	// defaultPingPeriod is how often clients are pinged.
+	// It must be less than defaultPongWait, to leave time
+	// for the pong.
+	defaultPingPeriod = defaultPongWait * 9 / 10
+	// defaultMaxMessageSize is the largest control message,
+	// in bytes, a client may send.
+	defaultMaxMessageSize = 4096
+	// defaultHistorySize is how many recent events
+	// are kept for clients that reconnect.
+	defaultHistorySize = 1000
+)
+
+// client is a WebSocket connection, the user it is
+// authenticated as, the topics it is subscribed to and
+// the queue of messages to send it.
+type client struct {
+	conn   *websocket.Conn
+	user   string
+	topics map[string]bool
+	// send is the queue of messages waiting to be
+	// written by the client's writer goroutine, in
+	// batches, so replaying the events a client missed
+	// takes up a single place in the queue. The Notifier
+	// closes it to stop the writer.
+	send chan [][]byte
+	// closeMsg is the close frame the writer sends after
+	// the last message in the queue, if any. It is set
+	// before send is closed.
+	closeMsg []byte
 }
 
 // Notifier is an object that handles WebSocket notifications.
+// Each client has a queue of messages and a goroutine writing
+// them out, so a slow client only holds up itself. A client
+// that falls so far behind that its queue fills up is
+// disconnected, and so is one that stops answering pings.
 type Notifier struct {
-	// slice and channels are reference type.
+	// maps are reference type.
 	// We need to initialize it somehow
-	// otherwise their zero value is nil,
+	// otherwise its zero value is nil,
 	// and we might get nil pointer reference error.
-	clients []*websocket.Conn
-	eventQ  chan []byte
+	clients map[*client]bool
 	// Add a mutex or other channels to
-	// protect the `clients` slice from concurrent use.
+	// protect the `clients` map, and the topics
+	// of each client, from concurrent use.
 	// Our NewNotifier() doesn't need to initialize mx field
 	// and we are still able to use it,
 	// because we are just using zero values for whatever in the Mutex struct fields.
+	// It is never held while doing I/O.
 	mx sync.Mutex
+	// writers counts the clients' writer goroutines.
+	writers sync.WaitGroup
+	// lastID is the ID of the last event, and history
+	// holds the most recent events.
+	lastID  uint64
+	history *history
+
+	queueSize      int
+	writeWait      time.Duration
+	pongWait       time.Duration
+	pingPeriod     time.Duration
+	maxMessageSize int64
 }
 
 // NewNotifier constructs a new Notifier.
 func NewNotifier() *Notifier {
-	// Construct a new Notifier
-	// and call the .start() method on
-	// a new goroutine to start the
-	// event notification loop.
-	notifier := &Notifier{
-		eventQ: make(chan []byte),
+	return &Notifier{
+		clients: map[*client]bool{},
+		// Starting from the clock keeps IDs increasing when the
+		// server restarts, so a client that reconnects after a
+		// restart finds out it missed events. Microseconds fit
+		// in the integers JavaScript can represent exactly.
+		lastID:         uint64(time.Now().UnixMicro()),
+		history:        newHistory(defaultHistorySize),
+		queueSize:      defaultQueueSize,
+		writeWait:      defaultWriteWait,
+		pongWait:       defaultPongWait,
+		pingPeriod:     defaultPingPeriod,
+		maxMessageSize: defaultMaxMessageSize,
 	}
-	go notifier.start()
-	return notifier
 }
 
-// AddClient adds a new client to the Notifier.
-func (n *Notifier) AddClient(client *websocket.Conn) {
+// AddClient adds a new client to the Notifier, for user,
+// which is "" if the client is anonymous. It isn't
+// subscribed to any topic until it sends a subscribe
+// control message.
+func (n *Notifier) AddClient(conn *websocket.Conn, user string) {
 	log.Println("adding new WebSockets client")
 
-	// Add the client to the `clients` slice
+	// Add the client to the `clients` map
 	// but since this can be called from multiple
 	// goroutines, make sure you protect the `clients`
-	// slice while you add a new connection to it!
+	// map while you add a new connection to it!
+	c := &client{
+		conn:   conn,
+		user:   user,
+		topics: map[string]bool{},
+		send:   make(chan [][]byte, n.queueSize),
+	}
 	n.mx.Lock()
-	n.clients = append(n.clients, client)
+	n.clients[c] = true
 	n.mx.Unlock()
+	n.writers.Add(1)
+	go n.writeLoop(c)
+
+	// A half-open TCP connection never returns an error
+	// from a read, so the read deadline is what notices a
+	// dead client: every pong, or any other message,
+	// pushes it back. Messages bigger than the limit make
+	// ReadMessage close the connection with 1009 (message
+	// too big), and a close frame from the client makes it
+	// reply with one of its own.
+	conn.SetReadLimit(n.maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(n.pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(n.pongWait))
+	})
 
 	// Process incoming control messages from the client.
-	// Once this client is added to the list, it will constantly
-	// send control messages to our server. If at one point,
-	// we get an error when reading those control messages,
-	// it informs us that connection is lost, and we need to
-	// remove it from the list.
+	// If at one point, we get an error when reading those
+	// control messages, it informs us that connection is
+	// lost, and we need to remove it from the list.
 	for {
-		if _, _, err := client.NextReader(); err != nil {
-			client.Close()
-			// Remove it from the list
-			n.mx.Lock()
-			for i, c := range n.clients {
-				if c == client {
-					n.clients = append(n.clients[:i], n.clients[i+1:]...)
-				}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSockets client disconnected: %v", err)
 			}
+			conn.Close()
+			n.mx.Lock()
+			n.removeClient(c, nil)
 			n.mx.Unlock()
-			break
+			return
 		}
+		conn.SetReadDeadline(time.Now().Add(n.pongWait))
+		n.control(c, data)
 	}
 }
 
-// Notify broadcasts the event to all WebSocket clients
-// by sending an event to the eventQ.
-func (n *Notifier) Notify(event []byte) {
-	log.Printf("adding event to the queue")
-	// Add `event` to the `n.eventQ`
-	n.eventQ <- event
-}
-
-// Start starts the notification loop.
-func (n *Notifier) start() {
-	log.Println("starting notifier loop")
-	// Start a never-ending loop that reads
-	// new events out of the `n.eventQ` and broadcasts
-	// them to all WebSocket clients.
-	for msg := range n.eventQ {
-		n.mx.Lock()
-		// Loop through all the existing clients,
-		// and send messages to all of them.
-		for i, c := range n.clients {
-			// If we encounter an error writing messages out,
-			// it means this connection is lost,
-			// and we need to remove it from the list.
-			if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
-				c.Close()
-				n.clients = append(n.clients[:i], n.clients[i+1:]...)
+// writeLoop writes the messages in the send queue of c to its
+// connection, and pings it, until the queue is closed or a
+// write fails. It is the only goroutine that writes messages
+// to the connection, as a websocket.Conn supports only one
+// writer at a time.
+func (n *Notifier) writeLoop(c *client) {
+	defer n.writers.Done()
+	ticker := time.NewTicker(n.pingPeriod)
+	defer ticker.Stop()
+	defer c.conn.Close()
+	for {
+		select {
+		case batch, ok := <-c.send:
+			if !ok {
+				// The Notifier removed the client,
+				// so say goodbye if there's a reason to.
+				if c.closeMsg != nil {
+					c.conn.SetWriteDeadline(time.Now().Add(n.writeWait))
+					c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg)
+				}
+				return
+			}
+			for _, msg := range batch {
+				// A write deadline stops a client that doesn't
+				// read from tying up this goroutine forever.
+				c.conn.SetWriteDeadline(time.Now().Add(n.writeWait))
+				if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+					// Closing the connection makes the read loop
+					// in AddClient fail, which removes the client.
+					log.Println(err)
+					return
+				}
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(n.writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				log.Println(err)
+				return
 			}
 		}
-		n.mx.Unlock()
 	}
 }
+
+// removeClient removes c from the clients, and closes its
+// queue so its writer goroutine stops after sending closeMsg,
+// if it isn't nil. It does nothing if c was already removed.
+// n.mx must be held.
+func (n *Notifier) removeClient(c *client, closeMsg []byte) {
+	if !n.clients[c] {
+		return
+	}
+	delete(n.clients, c)
+	c.closeMsg = closeMsg
+	close(c.send)
+}
+
+// Close disconnects every client with 1001 (going away),
+// after sending them the messages already in their queues,
+// and waits until they are all disconnected. Call it when
+// the server shuts down, after it stops accepting new
+// connections.
+func (n *Notifier) Close() {
+	n.mx.Lock()
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for c := range n.clients {
+		n.removeClient(c, closeMsg)
+	}
+	n.mx.Unlock()
+	n.writers.Wait()
+}
+
+// enqueue adds msgs to the queue of c without blocking.
+// If the queue is full, the client can't keep up, so
+// it is disconnected. n.mx must be held.
+func (n *Notifier) enqueue(c *client, msgs ...[]byte) {
+	if !n.clients[c] {
+		// It was removed, and its queue is closed.
+		return
+	}
+	select {
+	case c.send <- msgs:
+	default:
+		log.Println("disconnecting slow WebSockets client")
+		n.removeClient(c, nil)
+		// Don't wait for the writer to get through the queue:
+		// it's too slow to do it. WriteControl can be called
+		// alongside the writer, but it waits for it, so don't
+		// hold up the caller either.
+		go func() {
+			closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow")
+			c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			c.conn.Close()
+		}()
+	}
+}
+
+// control handles a control message from a client,
+// and replies to say whether it succeeded.
+func (n *Notifier) control(c *client, data []byte) {
+	cm := &ControlMessage{}
+	var reply *Message
+	switch err := json.Unmarshal(data, cm); {
+	case err != nil:
+		reply = &Message{Type: MessageError, Error: fmt.Sprintf("error decoding control message: %v", err)}
+	case len(cm.Topic) == 0:
+		reply = &Message{Type: MessageError, Error: "control message has no topic"}
+	case cm.Action == ActionSubscribe:
+		reply = &Message{Type: MessageSubscribed, Topic: cm.Topic}
+	case cm.Action == ActionUnsubscribe:
+		reply = &Message{Type: MessageUnsubscribed, Topic: cm.Topic}
+	default:
+		reply = &Message{Type: MessageError, Error: fmt.Sprintf("unknown action %q", cm.Action)}
+	}
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	var missed [][]byte
+	switch reply.Type {
+	case MessageSubscribed:
+		if cm.LastEventID > 0 && !c.topics[cm.Topic] {
+			missed, reply.Truncated = n.missed(c, cm.Topic, cm.LastEventID)
+		}
+		c.topics[cm.Topic] = true
+	case MessageUnsubscribed:
+		delete(c.topics, cm.Topic)
+	}
+	msg, err := json.Marshal(reply)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// Replay what the client missed right after the reply, and
+	// before anything else: we hold n.mx, so no new event can
+	// come between them.
+	n.enqueue(c, append([][]byte{msg}, missed...)...)
+}
+
+// missed returns the events of topic for c after the event with
+// ID lastID, and whether some of them aren't in the history any
+// more. n.mx must be held.
+func (n *Notifier) missed(c *client, topic string, lastID uint64) ([][]byte, bool) {
+	var msgs [][]byte
+	for _, ev := range n.history.since(lastID) {
+		if ev.topic == topic && (len(ev.user) == 0 || ev.user == c.user) {
+			msgs = append(msgs, ev.msg)
+		}
+	}
+	// The IDs in the history have no gaps, so the
+	// oldest one tells us if we dropped any after lastID.
+	oldest := n.lastID - uint64(n.history.count) + 1
+	return msgs, lastID+1 < oldest
+}
+
+// Notify sends the event to all WebSocket clients subscribed
+// to topic, by adding it to their queues. The payload must be
+// JSON. It never blocks on a client, so it is safe to call
+// from an HTTP handler.
+func (n *Notifier) Notify(topic string, payload []byte) error {
+	return n.notify("", topic, payload)
+}
+
+// NotifyUser is like Notify, but only sends the event to
+// the clients of user.
+func (n *Notifier) NotifyUser(user, topic string, payload []byte) error {
+	if len(user) == 0 {
+		return errors.New("error notifying user: no user")
+	}
+	return n.notify(user, topic, payload)
+}
+
+// notify sends the event to the clients subscribed to
+// topic, or only those of user if user isn't "".
+func (n *Notifier) notify(user, topic string, payload []byte) error {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	// The ID is given out while holding n.mx, so
+	// clients get events in the order of their IDs.
+	id := n.lastID + 1
+	msg, err := json.Marshal(&Message{Type: MessageEvent, ID: id, Topic: topic, Payload: payload})
+	if err != nil {
+		return fmt.Errorf("error encoding event: %v", err)
+	}
+	n.lastID = id
+	n.history.add(&historyEvent{id, user, topic, msg})
+
+	// Loop through all the existing clients, and queue
+	// the event for the subscribed ones. Deleting
+	// from a map while ranging over it is safe.
+	for c := range n.clients {
+		if c.topics[topic] && (len(user) == 0 || c.user == user) {
+			n.enqueue(c, msg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dial connects a new client to srv.
+func dial(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	t.Helper()
+	URL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(URL, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	return conn
+}
+
+// readMessage reads the next message sent to conn.
+func readMessage(t *testing.T, conn *websocket.Conn) *Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := &Message{}
+	if err := conn.ReadJSON(msg); err != nil {
+		t.Fatalf("error reading message: %v", err)
+	}
+	return msg
+}
+
+// control sends a control message and returns the reply.
+func control(t *testing.T, conn *websocket.Conn, action, topic string) *Message {
+	t.Helper()
+	if err := conn.WriteJSON(&ControlMessage{Action: action, Topic: topic}); err != nil {
+		t.Fatalf("error writing control message: %v", err)
+	}
+	return readMessage(t, conn)
+}
+
+func TestNotifierTopics(t *testing.T) {
+	n := NewNotifier()
+	srv := httptest.NewServer(NewWebSocketsHandler(n, WebSocketsConfig{}))
+	defer srv.Close()
+
+	builds, deploys := dial(t, srv), dial(t, srv)
+	defer builds.Close()
+	defer deploys.Close()
+
+	cases := []struct {
+		conn   *websocket.Conn
+		action string
+		topic  string
+		want   string
+	}{
+		{builds, ActionSubscribe, "builds", MessageSubscribed},
+		{deploys, ActionSubscribe, "deploys", MessageSubscribed},
+		{deploys, ActionSubscribe, "builds", MessageSubscribed},
+		{deploys, ActionUnsubscribe, "builds", MessageUnsubscribed},
+		{deploys, "publish", "builds", MessageError},
+		{deploys, ActionSubscribe, "", MessageError},
+	}
+	for _, c := range cases {
+		got := control(t, c.conn, c.action, c.topic)
+		if got.Type != c.want {
+			t.Errorf("\ninput: %s %q\ngot: %+v\nwant: %s", c.action, c.topic, got, c.want)
+		}
+	}
+
+	if err := n.Notify("builds", []byte(`{"build":1}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := n.Notify("deploys", []byte(`"v2"`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := n.Notify("deploys", []byte(`not JSON`)); err == nil {
+		t.Errorf("got no error for a payload that isn't JSON")
+	}
+
+	// Each client only gets the event of its topic.
+	for _, c := range []struct {
+		conn    *websocket.Conn
+		topic   string
+		payload string
+	}{
+		{builds, "builds", `{"build":1}`},
+		{deploys, "deploys", `"v2"`},
+	} {
+		got := readMessage(t, c.conn)
+		if got.Type != MessageEvent || got.Topic != c.topic || string(got.Payload) != c.payload {
+			t.Errorf("\ntopic: %s\ngot: %+v\nwant payload: %s", c.topic, got, c.payload)
+		}
+	}
+
+	// A malformed control message is an error, not a disconnect.
+	deploys.WriteMessage(websocket.TextMessage, []byte("{"))
+	if got := readMessage(t, deploys); got.Type != MessageError {
+		t.Errorf("got %+v, want an error", got)
+	}
+	if got := control(t, deploys, ActionSubscribe, "builds"); got.Type != MessageSubscribed {
+		t.Errorf("got %+v after an error, want to still be subscribed", got)
+	}
+}
+
+func TestNotifierSlowClient(t *testing.T) {
+	n := NewNotifier()
+	n.queueSize = 4
+	srv := httptest.NewServer(NewWebSocketsHandler(n, WebSocketsConfig{}))
+	defer srv.Close()
+
+	slow, fast := dial(t, srv), dial(t, srv)
+	defer slow.Close()
+	defer fast.Close()
+	control(t, slow, ActionSubscribe, "big")
+	control(t, fast, ActionSubscribe, "small")
+
+	// The slow client never reads, so once the TCP buffers are
+	// full its writer blocks, its queue fills up and it is
+	// disconnected. Notify doesn't wait for any of that.
+	payload := []byte(`"` + strings.Repeat("x", 1<<19) + `"`)
+	start := time.Now()
+	for i := 0; i < 64; i++ {
+		if err := n.Notify("big", payload); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Notify took %v, want it not to block", elapsed)
+	}
+
+	n.mx.Lock()
+	clients := len(n.clients)
+	n.mx.Unlock()
+	if clients != 1 {
+		t.Errorf("got %d clients, want the slow one disconnected", clients)
+	}
+
+	// The other client doesn't notice.
+	n.Notify("small", []byte(`1`))
+	if got := readMessage(t, fast); got.Type != MessageEvent || string(got.Payload) != "1" {
+		t.Errorf("got %+v, want the event", got)
+	}
+}
+
+// waitForClients waits until n has want clients.
+func waitForClients(t *testing.T, n *Notifier, want int) {
+	t.Helper()
+	got := 0
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		n.mx.Lock()
+		got = len(n.clients)
+		n.mx.Unlock()
+		if got == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got %d clients, want %d", got, want)
+}
+
+// readAll reads messages from conn in the background, which
+// also answers pings, and sends them on the returned channel.
+// The channel is closed when reading fails.
+func readAll(conn *websocket.Conn) <-chan *Message {
+	msgs := make(chan *Message, 10)
+	go func() {
+		defer close(msgs)
+		for {
+			msg := &Message{}
+			if err := conn.ReadJSON(msg); err != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	return msgs
+}
+
+func TestNotifierKeepalive(t *testing.T) {
+	n := NewNotifier()
+	n.pongWait = 200 * time.Millisecond
+	n.pingPeriod = 50 * time.Millisecond
+	srv := httptest.NewServer(NewWebSocketsHandler(n, WebSocketsConfig{}))
+	defer srv.Close()
+
+	alive, dead := dial(t, srv), dial(t, srv)
+	defer alive.Close()
+	defer dead.Close()
+	control(t, alive, ActionSubscribe, "news")
+	control(t, dead, ActionSubscribe, "news")
+	waitForClients(t, n, 2)
+
+	// The gorilla client only answers pings while reading,
+	// so a client that stops reading looks just like a
+	// half-open connection: the server gets no pongs.
+	msgs := readAll(alive)
+	waitForClients(t, n, 1)
+
+	// The client that answers pings stays,
+	// well past the time it takes to get a pong.
+	time.Sleep(4 * n.pongWait)
+	waitForClients(t, n, 1)
+	n.Notify("news", []byte(`"still here"`))
+	if got := <-msgs; got == nil || string(got.Payload) != `"still here"` {
+		t.Errorf("got %+v, want the event", got)
+	}
+}
+
+func TestNotifierCloseCodes(t *testing.T) {
+	n := NewNotifier()
+	srv := httptest.NewServer(NewWebSocketsHandler(n, WebSocketsConfig{}))
+	defer srv.Close()
+
+	// A message over the size limit.
+	conn := dial(t, srv)
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat(" ", defaultMaxMessageSize+1)))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("got %v, want close code %d", err, websocket.CloseMessageTooBig)
+	}
+	waitForClients(t, n, 0)
+
+	// The client closes the connection.
+	conn = dial(t, srv)
+	defer conn.Close()
+	control(t, conn, ActionSubscribe, "news")
+	waitForClients(t, n, 1)
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("got %v, want the close frame echoed", err)
+	}
+	waitForClients(t, n, 0)
+
+	// The server shuts down, after sending what is queued.
+	conn = dial(t, srv)
+	defer conn.Close()
+	control(t, conn, ActionSubscribe, "news")
+	n.Notify("news", []byte(`"last"`))
+	n.Close()
+	if got := readMessage(t, conn); string(got.Payload) != `"last"` {
+		t.Errorf("got %+v, want the queued event", got)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("got %v, want close code %d", err, websocket.CloseGoingAway)
+	}
+	waitForClients(t, n, 0)
+}
+
+// notifyBuilds sends events 1 to 3 for builds to n, each
+// followed by an event for deploys, and returns their IDs.
+func notifyBuilds(t *testing.T, n *Notifier, srv *httptest.Server) []uint64 {
+	t.Helper()
+	conn := dial(t, srv)
+	defer conn.Close()
+	control(t, conn, ActionSubscribe, "builds")
+	var ids []uint64
+	for i := 1; i <= 3; i++ {
+		n.Notify("builds", []byte(fmt.Sprint(i)))
+		n.Notify("deploys", []byte(`"other topic"`))
+		got := readMessage(t, conn)
+		if len(ids) > 0 && got.ID <= ids[len(ids)-1] {
+			t.Errorf("got ID %d after %d, want IDs to increase", got.ID, ids[len(ids)-1])
+		}
+		ids = append(ids, got.ID)
+	}
+	return ids
+}
+
+func TestNotifierReplay(t *testing.T) {
+	cases := []struct {
+		name string
+		// lastEventID returns the ID to reconnect
+		// with, from the IDs of the 3 builds events.
+		lastEventID   func(ids []uint64) uint64
+		wantPayloads  []string
+		wantTruncated bool
+	}{
+		// The connection dropped after the first event.
+		{"missed two", func(ids []uint64) uint64 { return ids[0] }, []string{"2", "3"}, false},
+		{"missed none", func(ids []uint64) uint64 { return ids[2] }, nil, false},
+		{"no ID", func(ids []uint64) uint64 { return 0 }, nil, false},
+		// The history holds 5 of the 6 events,
+		// so the first one for builds is gone.
+		{"too old", func(ids []uint64) uint64 { return ids[0] - 1 }, []string{"2", "3"}, true},
+	}
+	for _, c := range cases {
+		n := NewNotifier()
+		n.history = newHistory(5)
+		srv := httptest.NewServer(NewWebSocketsHandler(n, WebSocketsConfig{}))
+		ids := notifyBuilds(t, n, srv)
+
+		conn := dial(t, srv)
+		if err := conn.WriteJSON(&ControlMessage{ActionSubscribe, "builds", c.lastEventID(ids)}); err != nil {
+			t.Fatalf("error writing control message: %v", err)
+		}
+		reply := readMessage(t, conn)
+		if reply.Type != MessageSubscribed || reply.Truncated != c.wantTruncated {
+			t.Errorf("\ncase: %s\ngot reply: %+v\nwant truncated: %v", c.name, reply, c.wantTruncated)
+		}
+		var got []string
+		for range c.wantPayloads {
+			got = append(got, string(readMessage(t, conn).Payload))
+		}
+		if strings.Join(got, ",") != strings.Join(c.wantPayloads, ",") {
+			t.Errorf("\ncase: %s\ngot replayed: %v\nwant: %v", c.name, got, c.wantPayloads)
+		}
+
+		// Then live events follow.
+		n.Notify("builds", []byte(`"live"`))
+		if got := readMessage(t, conn); string(got.Payload) != `"live"` {
+			t.Errorf("\ncase: %s\ngot: %+v\nwant the live event", c.name, got)
+		}
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	for id := uint64(1); id <= 5; id++ {
+		h.add(&historyEvent{id: id})
+	}
+	var got []uint64
+	for _, ev := range h.since(0) {
+		got = append(got, ev.id)
+	}
+	if fmt.Sprint(got) != "[3 4 5]" {
+		t.Errorf("got %v, want the last 3 events", got)
+	}
+	if events := h.since(4); len(events) != 1 || events[0].id != 5 {
+		t.Errorf("got %v since 4, want event 5", events)
+	}
+}
@@ -1,29 +1,153 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"github.com/zicodeng/go-example/websocket/handlers"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"time"
 )
 
 // NotificationsHandler handles requests for the /notifications resource.
 type NotificationsHandler struct {
-	notifier *handlers.Notifier
+	notifier       *handlers.Notifier
+	auth           handlers.Authenticator
+	publisherToken string
 }
 
-// NewNotificationsHandler constructs a new NotificationsHandler.
-func NewNotificationsHandler(notifier *handlers.Notifier) *NotificationsHandler {
-	return &NotificationsHandler{notifier}
+// NewNotificationsHandler constructs a new NotificationsHandler
+// that takes notifications for anyone from callers sending
+// publisherToken as their bearer token, and notifications for
+// themselves from the users auth accepts. An empty
+// publisherToken lets no one notify other users.
+func NewNotificationsHandler(notifier *handlers.Notifier, auth handlers.Authenticator, publisherToken string) *NotificationsHandler {
+	return &NotificationsHandler{notifier, auth, publisherToken}
+}
+
+// maxNotificationBytes is the largest notification we accept.
+const maxNotificationBytes = 1 << 20
+
+// Notification is the body of a POST to /notifications:
+// the payload is sent to the clients subscribed to the topic,
+// or only those of the user, if there is one.
+type Notification struct {
+	Topic   string          `json:"topic"`
+	User    string          `json:"user,omitempty"`
+	Payload json.RawMessage `json:"payload"`
 }
 
 // ServeHTTP handles HTTP requests for the NotificationsHandler.
+// Other servers send the publisher token, and can notify any user
+// or topic. Signed in users, like our page with its login cookie,
+// can only notify themselves, so a session can't be used to push
+// messages to other people. The cookie is SameSite, so pages on
+// other sites can't make the browser send it, and we send no CORS
+// headers to let them in.
 func (nh *NotificationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	msg := fmt.Sprintf("Notification pushed from the server at %s", time.Now().Format("15:04:05"))
-	nh.notifier.Notify([]byte(msg))
+	if r.Method != http.MethodPost {
+		http.Error(w, "method must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	publisher := nh.isPublisher(r)
+	var user string
+	if !publisher {
+		var err error
+		if user, err = nh.auth.Authenticate(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	notification := &Notification{}
+	r.Body = http.MaxBytesReader(w, r.Body, maxNotificationBytes)
+	if err := json.NewDecoder(r.Body).Decode(notification); err != nil {
+		http.Error(w, fmt.Sprintf("error decoding notification: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(notification.Topic) == 0 {
+		http.Error(w, "notification has no topic", http.StatusBadRequest)
+		return
+	}
+	if len(notification.Payload) == 0 {
+		notification.Payload = json.RawMessage("null")
+	}
+	if !publisher {
+		if len(notification.User) == 0 {
+			notification.User = user
+		}
+		if notification.User != user {
+			http.Error(w, "users can only notify themselves", http.StatusForbidden)
+			return
+		}
+	}
+
+	var err error
+	if len(notification.User) > 0 {
+		err = nh.notifier.NotifyUser(notification.User, notification.Topic, notification.Payload)
+	} else {
+		err = nh.notifier.Notify(notification.Topic, notification.Payload)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// isPublisher reports whether r has the publisher token
+// as its bearer token.
+func (nh *NotificationsHandler) isPublisher(r *http.Request) bool {
+	if len(nh.publisherToken) == 0 {
+		return false
+	}
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	// ConstantTimeCompare doesn't give away how much of
+	// the token matched by how long it takes.
+	return found && strings.EqualFold(scheme, handlers.BearerProtocol) &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(nh.publisherToken)) == 1
+}
+
+// sessionDuration is how long a login lasts.
+const sessionDuration = 24 * time.Hour
+
+// LoginHandler logs users in, by setting a cookie
+// the WebSocketsHandler authenticates them with.
+type LoginHandler struct {
+	auth *handlers.TokenAuthenticator
+}
+
+// ServeHTTP handles HTTP requests for the LoginHandler.
+// It stands in for a real login, and trusts whatever user
+// is in the query string, so it is only served in development.
+func (lh *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if len(user) == 0 {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, lh.auth.Cookie(user, time.Now().Add(sessionDuration)))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// getKey returns the key to sign tokens with from the
+// WEBSOCKETS_KEY environment variable, or a random key.
+func getKey() []byte {
+	if key := os.Getenv("WEBSOCKETS_KEY"); len(key) > 0 {
+		return []byte(key)
+	}
+	log.Println("WEBSOCKETS_KEY is not set, so logins won't survive a restart")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("error generating key: %v", err)
+	}
+	return key
 }
 
 func main() {
@@ -32,12 +156,55 @@ func main() {
 		addr = "localhost:4000"
 	}
 
+	// Pages on other origins allowed to connect,
+	// separated by commas and maybe spaces.
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			origins = append(origins, origin)
+		}
+	}
+	auth := handlers.NewTokenAuthenticator(getKey(), "")
+
 	notifier := handlers.NewNotifier()
 
 	mux := http.NewServeMux()
-	mux.Handle("/websockets", handlers.NewWebSocketsHandler(notifier))
-	mux.Handle("/notifications", NewNotificationsHandler(notifier))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "index.html")
+	})
+	// Anyone can log in as anyone with /login,
+	// so it has to be turned on explicitly.
+	if os.Getenv("DEV_LOGIN") == "true" {
+		log.Println("DEV_LOGIN is set, so anyone can log in as any user at /login")
+		mux.Handle("/login", &LoginHandler{auth})
+	}
+	mux.Handle("/websockets", handlers.NewWebSocketsHandler(notifier, handlers.WebSocketsConfig{
+		AllowedOrigins: origins,
+		Auth:           auth,
+	}))
+	// Other servers send NOTIFY_TOKEN as their bearer
+	// token to notify users other than themselves.
+	mux.Handle("/notifications", NewNotificationsHandler(notifier, auth, os.Getenv("NOTIFY_TOKEN")))
+
+	// On Ctrl-C, tell the WebSocket clients we are going away
+	// before shutting down. Shutdown doesn't know about them,
+	// as their connections were hijacked from the server.
+	srv := &http.Server{Addr: addr, Handler: mux}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+		notifier.Close()
+	}()
 
 	log.Printf("server is listening at http://%s...", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zicodeng/go-example/websocket/handlers"
+)
+
+func TestNotificationsHandlerAuthorizes(t *testing.T) {
+	auth := handlers.NewTokenAuthenticator([]byte("test key"), "")
+	notifier := handlers.NewNotifier()
+	defer notifier.Close()
+	nh := NewNotificationsHandler(notifier, auth, "publisher token")
+
+	alice := auth.Sign("alice", time.Now().Add(time.Hour))
+	cases := []struct {
+		name         string
+		token        string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "no token",
+			body:         `{"topic": "demo"}`,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "user notifying themselves",
+			token:        alice,
+			body:         `{"topic": "demo", "user": "alice"}`,
+			expectedCode: http.StatusAccepted,
+		},
+		{
+			name:         "user notifying without a user",
+			token:        alice,
+			body:         `{"topic": "demo"}`,
+			expectedCode: http.StatusAccepted,
+		},
+		{
+			name:         "user notifying another user",
+			token:        alice,
+			body:         `{"topic": "demo", "user": "bob"}`,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "publisher notifying another user",
+			token:        "publisher token",
+			body:         `{"topic": "demo", "user": "bob"}`,
+			expectedCode: http.StatusAccepted,
+		},
+		{
+			name:         "publisher notifying everyone",
+			token:        "publisher token",
+			body:         `{"topic": "demo"}`,
+			expectedCode: http.StatusAccepted,
+		},
+		{
+			name:         "wrong publisher token",
+			token:        "publisher tokem",
+			body:         `{"topic": "demo", "user": "bob"}`,
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/notifications", strings.NewReader(c.body))
+		if len(c.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		nh.ServeHTTP(w, r)
+		if w.Code != c.expectedCode {
+			t.Errorf("\ncase: %s\ngot: %d %s\nwant: %d", c.name, w.Code, w.Body.String(), c.expectedCode)
+		}
+	}
+}